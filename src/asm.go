@@ -0,0 +1,198 @@
+package main
+
+// Single line assembler
+//
+// The asm command encodes an instruction written in the cowgod syntax of the
+// disassembler ("DRW VA, VB, 0x5", "JP 0x22a" or "JMP 0x22a", "SHR V3 {,
+// V4}", "DW 0x1234" or "DB 0x80, 0x80" for data) and writes it to memory,
+// showing the instruction before and after. Addresses can be given as labels
+// of the symbols. Every patch is recorded so that it can be undone, the
+// latest first. Instructions are decoded from memory at every step, so the
+// patched instruction is the one executed next time.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type asmPatch struct {
+	address  uint16
+	previous [2]byte
+}
+
+// asmPatches is the undo stack of the patches, the latest last.
+var asmPatches []asmPatch
+
+// asmForms gives the opcode of every form of instruction, operands being
+// written V for registers and n for numbers.
+var asmForms = map[string]uint16{
+	"SYS n":     0x0000,
+	"CLS":       0x00e0,
+	"RET":       0x00ee,
+	"JP n":      0x1000,
+	"JMP n":     0x1000,
+	"CALL n":    0x2000,
+	"SE V,n":    0x3000,
+	"SNE V,n":   0x4000,
+	"SE V,V":    0x5000,
+	"LD V,n":    0x6000,
+	"ADD V,n":   0x7000,
+	"LD V,V":    0x8000,
+	"OR V,V":    0x8001,
+	"AND V,V":   0x8002,
+	"XOR V,V":   0x8003,
+	"ADD V,V":   0x8004,
+	"SUB V,V":   0x8005,
+	"SHR V":     0x8006,
+	"SHR V,V":   0x8006,
+	"SUBN V,V":  0x8007,
+	"SHL V":     0x800e,
+	"SHL V,V":   0x800e,
+	"SNE V,V":   0x9000,
+	"LD I,n":    0xa000,
+	"JP V,n":    0xb000,
+	"JMP V,n":   0xb000,
+	"RND V,n":   0xc000,
+	"DRW V,V,n": 0xd000,
+	"SKP V":     0xe09e,
+	"SKNP V":    0xe0a1,
+	"LD V,DT":   0xf007,
+	"LD V,K":    0xf00a,
+	"LD DT,V":   0xf015,
+	"LD ST,V":   0xf018,
+	"ADD I,V":   0xf01e,
+	"LD F,V":    0xf029,
+	"LD B,V":    0xf033,
+	"LD [I],V":  0xf055,
+	"LD V,[I]":  0xf065,
+	"DW n":      0x0000,
+	"DB n,n":    0x0000,
+}
+
+// asmCommand assembles an instruction at an address, asm <address>
+// <instruction>, undoes the latest patch with asm undo, or lists the
+// patches.
+func asmCommand(args []string) error {
+	if len(args) == 0 {
+		for _, patch := range asmPatches {
+			fmt.Printf("0x%03x: 0x%02x%02x -> 0x%04x %s\n", patch.address, patch.previous[0], patch.previous[1],
+				machineGetInstruction(patch.address), disasmInstruction(patch.address))
+		}
+		return nil
+	}
+
+	if args[0] == "undo" {
+		if len(asmPatches) == 0 {
+			return errors.New("no patch to undo")
+		}
+		patch := asmPatches[len(asmPatches)-1]
+		asmPatches = asmPatches[:len(asmPatches)-1]
+		asmWrite(patch.address, patch.previous)
+		return nil
+	}
+
+	if len(args) < 2 {
+		return errors.New("missing instruction")
+	}
+	address, err := asmNumber(args[0])
+	if err != nil || address < MEMPROGRAMSTART || address >= MEMEND-1 {
+		return errors.New("invalid address")
+	}
+	op, err := asmEncode(strings.Join(args[1:], " "))
+	if err != nil {
+		return err
+	}
+	asmPatches = append(asmPatches, asmPatch{address, [2]byte{m.memory[address], m.memory[address+1]}})
+	asmWrite(address, [2]byte{byte(op >> 8), byte(op)})
+	return nil
+}
+
+// asmEncode returns the opcode of an instruction.
+func asmEncode(text string) (uint16, error) {
+	fields := strings.Fields(strings.NewReplacer(",", " ", "{", " ", "}", " ").Replace(text))
+	if len(fields) == 0 {
+		return 0, errors.New("missing instruction")
+	}
+	mnemonic := strings.ToUpper(fields[0])
+
+	// classify the operands to find the form of the instruction
+	kinds := []string{}
+	for _, operand := range fields[1:] {
+		switch name := strings.ToUpper(operand); {
+		case name == "I" || name == "DT" || name == "ST" || name == "K" || name == "F" || name == "B" || name == "[I]":
+			kinds = append(kinds, name)
+		case len(name) == 2 && name[0] == 'V' && strings.ContainsRune("0123456789ABCDEF", rune(name[1])):
+			kinds = append(kinds, "V")
+		default:
+			kinds = append(kinds, "n")
+		}
+	}
+	form := strings.TrimSpace(mnemonic + " " + strings.Join(kinds, ","))
+	op, ok := asmForms[form]
+	if !ok {
+		return 0, fmt.Errorf("invalid instruction %s", text)
+	}
+
+	// the largest number the operands can be
+	limit := uint16(0xfff)
+	switch form {
+	case "DW n":
+		limit = 0xffff
+	case "DB n,n", "SE V,n", "SNE V,n", "LD V,n", "ADD V,n", "RND V,n":
+		limit = 0xff
+	case "DRW V,V,n":
+		limit = 0xf
+	}
+
+	registers := 0
+	for n, kind := range kinds {
+		operand := fields[n+1]
+		switch kind {
+		case "V":
+			x, _ := strconv.ParseUint(operand[1:], 16, 4)
+			if form == "JP V,n" || form == "JMP V,n" {
+				if x != 0 {
+					return 0, errors.New("only V0 can be added to jump addresses")
+				}
+			} else if registers == 0 {
+				op |= uint16(x) << 8
+			} else {
+				op |= uint16(x) << 4
+			}
+			registers++
+		case "n":
+			value, err := asmNumber(operand)
+			if err != nil {
+				return 0, err
+			}
+			if value > limit {
+				return 0, fmt.Errorf("%s out of range, at most 0x%x", operand, limit)
+			}
+			if mnemonic == "DB" && n == 0 {
+				value <<= 8
+			}
+			op |= value
+		}
+	}
+	return op, nil
+}
+
+// asmNumber parses a number as cliParseNumber does, or returns the address
+// of a label.
+func asmNumber(s string) (uint16, error) {
+	if address, ok := symbols.labels[s]; ok {
+		return address, nil
+	}
+	return cliParseNumber(s)
+}
+
+// asmWrite writes an opcode, showing the instruction before and after.
+func asmWrite(address uint16, op [2]byte) {
+	fmt.Print("- ")
+	cliPrintInstruction(address)
+	m.memory[address], m.memory[address+1] = op[0], op[1]
+	fmt.Print("+ ")
+	cliPrintInstruction(address)
+}
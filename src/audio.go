@@ -1,57 +1,193 @@
 package main
 
-// typedef unsigned char Uint8;
-// void SineWave(void *userdata, Uint8 *stream, int len);
-import "C"
+// Beeper
+//
+// The CHIP-8 beeper sounds while the sound timer is not zero. At every 60Hz
+// frame, the machine tells whether it sounded and the samples of the frame
+// are generated: a square or sine wave whose phase carries on from one frame
+// to the next, ramped up and down over a millisecond to avoid clicks. The
+// samples are queued to the SDL audio device, which only holds a few frames
+// ahead to keep the latency low, unless the beeper is muted, and passed to
+// the WAV recorder if any.
+
 import (
-	"log"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"math"
-	"reflect"
-	"unsafe"
+	"strconv"
 
 	"github.com/veandco/go-sdl2/sdl"
 )
 
 const (
-	toneHz   = 440
-	sampleHz = 48000
-	dPhase   = 2 * math.Pi * toneHz / sampleHz
+	AUDIOSAMPLEHZ     = 48000
+	AUDIOFRAMESAMPLES = AUDIOSAMPLEHZ / 60
+	AUDIORAMPSAMPLES  = AUDIOSAMPLEHZ / 1000
+	AUDIOMAXQUEUED    = 3 * AUDIOFRAMESAMPLES // samples
 )
 
-//export SineWave
-func SineWave(userdata unsafe.Pointer, stream *C.Uint8, length C.int) {
-	n := int(length)
-	hdr := reflect.SliceHeader{Data: uintptr(unsafe.Pointer(stream)), Len: n, Cap: n}
-	buf := *(*[]C.Uint8)(unsafe.Pointer(&hdr))
+type audioSettings struct {
+	waveform string  // square or sine
+	pitch    float64 // Hz
+	volume   float64 // 0 to 1
+	muted    bool
+}
+
+var audio = audioSettings{waveform: "square", pitch: 440, volume: 0.25}
+
+// audioState is the state of the generator carried from frame to frame.
+var audioState struct {
+	phase float64 // 0 to 1
+	level float64 // amplitude, ramped from 0 to 1 and back
+}
 
-	var phase float64
-	for i := 0; i < n; i += 2 {
-		phase += dPhase
-		sample := C.Uint8((math.Sin(phase) + 0.999999) * 128)
-		buf[i] = sample
-		buf[i+1] = sample
+// audioDevice is the SDL audio device, 0 unless opened by audioOpen.
+var audioDevice sdl.AudioDeviceID
+
+// audioClose closes the audio device if it was opened.
+func audioClose() {
+	if audioDevice != 0 {
+		sdl.CloseAudioDevice(audioDevice)
+		audioDevice = 0
 	}
 }
 
-func main() {
-	if err := sdl.Init(sdl.INIT_AUDIO); err != nil {
-		log.Println(err)
+func audioCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("waveform %s\n", audio.waveform)
+		fmt.Printf("pitch    %gHz\n", audio.pitch)
+		fmt.Printf("volume   %d%%\n", int(audio.volume*100+0.5))
+		fmt.Printf("muted    %t\n", audio.muted)
+		return nil
+	}
+
+	switch args[0] {
+	case "on":
+		audio.muted = false
+	case "off":
+		audio.muted = true
+	case "wave", "pitch", "volume":
+		if len(args) < 2 {
+			return fmt.Errorf("missing %s value", args[0])
+		}
+		return audioSet(args[0], args[1])
+	default:
+		return fmt.Errorf("invalid sound command %s", args[0])
+	}
+	return nil
+}
+
+// audioFrameTick is called by the machine for every 60Hz frame, beeping
+// telling whether the sound timer was set during the frame.
+func audioFrameTick(beeping bool) {
+	// nothing to play once the beeper is silent
+	if !beeping && audioState.level == 0 {
+		audioState.phase = 0
+		wavRecord(make([]int16, AUDIOFRAMESAMPLES))
 		return
 	}
-	defer sdl.Quit()
+	samples := audioGenerate(AUDIOFRAMESAMPLES, beeping)
+	wavRecord(samples)
+	if !audio.muted {
+		audioQueue(samples)
+	}
+}
 
+// audioGenerate returns count samples of the beeper, sounding or not.
+func audioGenerate(count int, sounding bool) []int16 {
+	s := &audioState
+	samples := make([]int16, count)
+	for n := range samples {
+		switch {
+		case sounding && s.level < 1:
+			s.level = math.Min(1, s.level+1.0/AUDIORAMPSAMPLES)
+		case !sounding && s.level > 0:
+			s.level = math.Max(0, s.level-1.0/AUDIORAMPSAMPLES)
+		}
+
+		var wave float64
+		if audio.waveform == "sine" {
+			wave = math.Sin(2 * math.Pi * s.phase)
+		} else if s.phase < 0.5 {
+			wave = 1
+		} else {
+			wave = -1
+		}
+		samples[n] = int16(wave * s.level * audio.volume * math.MaxInt16)
+
+		s.phase += audio.pitch / AUDIOSAMPLEHZ
+		s.phase -= math.Floor(s.phase)
+	}
+	return samples
+}
+
+// audioOpen opens the default audio device, playing 16 bits mono samples
+// queued by audioQueue.
+func audioOpen() error {
 	spec := &sdl.AudioSpec{
-		Freq:     sampleHz,
-		Format:   sdl.AUDIO_U8,
-		Channels: 2,
-		Samples:  sampleHz,
-		Callback: sdl.AudioCallback(C.SineWave),
-	}
-	if err := sdl.OpenAudio(spec, nil); err != nil {
-		log.Println(err)
+		Freq:     AUDIOSAMPLEHZ,
+		Format:   sdl.AUDIO_S16LSB,
+		Channels: 1,
+		Samples:  512,
+	}
+	device, err := sdl.OpenAudioDevice("", false, spec, nil, 0)
+	if err != nil {
+		return err
+	}
+	audioDevice = device
+	sdl.PauseAudioDevice(audioDevice, false)
+	return nil
+}
+
+// audioQueue queues samples to the audio device. When the queue runs dry,
+// the frame is preceded by a few milliseconds of silence, so that the next
+// frames have time to come; when the machine runs ahead, frames are dropped.
+func audioQueue(samples []int16) {
+	if audioDevice == 0 {
+		return
+	}
+	queued := int(sdl.GetQueuedAudioSize(audioDevice)) / 2
+	if queued > AUDIOMAXQUEUED {
 		return
 	}
-	sdl.PauseAudio(false)
-	sdl.Delay(5000) // play audio for long enough to understand whether it works
-	sdl.CloseAudio()
+	if queued == 0 {
+		samples = append(make([]int16, AUDIOFRAMESAMPLES/2), samples...)
+	}
+
+	data := make([]byte, 2*len(samples))
+	for n, sample := range samples {
+		binary.LittleEndian.PutUint16(data[2*n:], uint16(sample))
+	}
+	sdl.QueueAudio(audioDevice, data)
+}
+
+// audioSet changes one setting: wave (square or sine), pitch (Hz) or volume
+// (0 to 100%).
+func audioSet(name string, value string) error {
+	switch name {
+	case "wave":
+		if value != "square" && value != "sine" {
+			return fmt.Errorf("invalid waveform %s, expected square or sine", value)
+		}
+		audio.waveform = value
+
+	case "pitch":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 20 || f > 20000 {
+			return fmt.Errorf("invalid pitch %s, expected 20 to 20000Hz", value)
+		}
+		audio.pitch = f
+
+	case "volume":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 100 {
+			return fmt.Errorf("invalid volume %s, expected 0 to 100", value)
+		}
+		audio.volume = float64(n) / 100
+
+	default:
+		return errors.New("unknown sound setting " + name)
+	}
+	return nil
 }
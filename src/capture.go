@@ -0,0 +1,367 @@
+package main
+
+// Screenshots and recordings of the display
+//
+// Screenshots are written as PNG or PBM files depending on the file name
+// extension. Recordings capture one frame per 60Hz tick of the machine and
+// are written as animated GIF or APNG files when they stop. Consecutive
+// identical frames are merged into a longer one.
+//
+// Both work from the display as shown by the frontends, filters included
+// (see filter.go), and do not depend on the frontend.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type captureFrame filterLevels
+
+// captureRun is a frame displayed for several ticks.
+type captureRun struct {
+	frame captureFrame
+	start int // tick the frame appeared
+	ticks int
+}
+
+type captureRecording struct {
+	path    string
+	scale   int
+	palette palette
+	ticks   int
+	runs    []captureRun
+	wav     bool // the sound is recorded along, see wav.go
+}
+
+// captureRecorder is nil unless a recording is in progress.
+var captureRecorder *captureRecording
+
+// captureArgs parses the optional [scale] [palette] arguments.
+func captureArgs(args []string) (int, palette, error) {
+	scale := 8
+	p := displayPalette
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			if n < 1 {
+				return 0, p, fmt.Errorf("invalid scale %s", arg)
+			}
+			scale = n
+			continue
+		}
+		var err error
+		if p, err = paletteParse(arg); err != nil {
+			return 0, p, err
+		}
+	}
+	return scale, p, nil
+}
+
+// captureEncodeAPNG writes an animated PNG, see
+// https://wiki.mozilla.org/APNG_Specification
+// The frames are encoded by image/png, their image data chunks are then
+// moved into the frame chunks of the animation.
+func captureEncodeAPNG(w io.Writer, runs []captureRun, scale int, p palette) error {
+	chunk := func(kind string, data []byte) {
+		binary.Write(w, binary.BigEndian, uint32(len(data)))
+		crc := crc32.NewIEEE()
+		io.WriteString(crc, kind)
+		crc.Write(data)
+		io.WriteString(w, kind)
+		w.Write(data)
+		binary.Write(w, binary.BigEndian, crc.Sum32())
+	}
+
+	// frame delays are 16 bits numbers of ticks, so longer runs are split in
+	// several frames of the same image
+	const maxDelay = 0xffff
+	frames := 0
+	for _, run := range runs {
+		frames += (run.ticks + maxDelay - 1) / maxDelay
+	}
+
+	io.WriteString(w, "\x89PNG\r\n\x1a\n")
+	sequence := uint32(0)
+	for n, run := range runs {
+		var encoded bytes.Buffer
+		if err := png.Encode(&encoded, captureImage(&run.frame, scale, p)); err != nil {
+			return err
+		}
+		chunks, err := capturePNGChunks(encoded.Bytes())
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			// all the frames share the header and palette of the first one
+			chunk("IHDR", chunks["IHDR"])
+			actl := make([]byte, 8)
+			binary.BigEndian.PutUint32(actl[0:], uint32(frames))
+			binary.BigEndian.PutUint32(actl[4:], 0) // loop forever
+			chunk("acTL", actl)
+			chunk("PLTE", chunks["PLTE"])
+		}
+
+		for ticks := run.ticks; ticks > 0; ticks -= maxDelay {
+			delay := ticks
+			if delay > maxDelay {
+				delay = maxDelay
+			}
+			fctl := make([]byte, 26)
+			binary.BigEndian.PutUint32(fctl[0:], sequence)
+			binary.BigEndian.PutUint32(fctl[4:], SCREENWIDTH*uint32(scale))
+			binary.BigEndian.PutUint32(fctl[8:], SCREENHEIGHT*uint32(scale))
+			// x and y offsets are 0
+			binary.BigEndian.PutUint16(fctl[20:], uint16(delay))
+			binary.BigEndian.PutUint16(fctl[22:], 60)
+			// dispose and blend operations are 0: none and source
+			chunk("fcTL", fctl)
+			sequence++
+
+			if sequence == 1 {
+				chunk("IDAT", chunks["IDAT"])
+			} else {
+				fdat := make([]byte, 4, 4+len(chunks["IDAT"]))
+				binary.BigEndian.PutUint32(fdat, sequence)
+				chunk("fdAT", append(fdat, chunks["IDAT"]...))
+				sequence++
+			}
+		}
+	}
+	chunk("IEND", nil)
+	return nil
+}
+
+// captureEncodeGIF writes an animated GIF. GIF delays are in hundredths of a
+// second and most viewers slow down frames shorter than 2/100s, so frames
+// are timed from their start tick and too short frames are dropped.
+func captureEncodeGIF(w io.Writer, runs []captureRun, scale int, p palette) error {
+	centiseconds := func(tick int) int {
+		return (tick*100 + 30) / 60
+	}
+
+	animation := &gif.GIF{}
+	starts := make([]int, 0, len(runs))
+	end := 0
+	for _, run := range runs {
+		start := centiseconds(run.start)
+		end = centiseconds(run.start + run.ticks)
+		if n := len(starts); n > 0 && start-starts[n-1] < 2 {
+			continue
+		}
+		animation.Image = append(animation.Image, captureImage(&run.frame, scale, p))
+		starts = append(starts, start)
+	}
+	for n := range starts {
+		next := end
+		if n+1 < len(starts) {
+			next = starts[n+1]
+		}
+		delay := next - starts[n]
+		if delay < 2 {
+			delay = 2
+		}
+		animation.Delay = append(animation.Delay, delay)
+	}
+	return gif.EncodeAll(w, animation)
+}
+
+// captureFrameTick is called by the machine for every 60Hz frame.
+func captureFrameTick() {
+	r := captureRecorder
+	if r == nil {
+		return
+	}
+
+	frame := captureFrame(filterOutput())
+	if n := len(r.runs); n > 0 && r.runs[n-1].frame == frame {
+		r.runs[n-1].ticks++
+	} else {
+		r.runs = append(r.runs, captureRun{frame, r.ticks, 1})
+	}
+	r.ticks++
+}
+
+// captureImage draws a frame with one palette entry per level of brightness.
+func captureImage(frame *captureFrame, scale int, p palette) *image.Paletted {
+	colors := make(color.Palette, FILTERLEVELS)
+	for level := range colors {
+		colors[level] = filterColor(uint8(level), p)
+	}
+	img := image.NewPaletted(image.Rect(0, 0, SCREENWIDTH*scale, SCREENHEIGHT*scale), colors)
+	for y := 0; y < SCREENHEIGHT*scale; y++ {
+		for x := 0; x < SCREENWIDTH*scale; x++ {
+			img.SetColorIndex(x, y, frame[x/scale][y/scale])
+		}
+	}
+	return img
+}
+
+// capturePNGChunks returns the data of the chunks of a PNG file, IDAT chunks
+// being concatenated.
+func capturePNGChunks(data []byte) (map[string][]byte, error) {
+	chunks := make(map[string][]byte)
+	data = data[8:]
+	for len(data) >= 12 {
+		length := int(binary.BigEndian.Uint32(data))
+		if len(data) < 12+length {
+			break
+		}
+		kind := string(data[4:8])
+		chunks[kind] = append(chunks[kind], data[8:8+length]...)
+		data = data[12+length:]
+	}
+	if chunks["IHDR"] == nil || chunks["IDAT"] == nil {
+		return nil, errors.New("invalid PNG data")
+	}
+	return chunks, nil
+}
+
+func captureRecord(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing start or stop")
+	}
+
+	switch args[0] {
+	case "start":
+		if captureRecorder != nil {
+			return fmt.Errorf("already recording to %s", captureRecorder.path)
+		}
+		if len(args) < 2 {
+			return errors.New("missing file name")
+		}
+		switch strings.ToLower(filepath.Ext(args[1])) {
+		case ".gif", ".png", ".apng":
+		default:
+			return errors.New("recordings are written as .gif, .png or .apng files")
+		}
+		options, wav := []string{}, false
+		for _, arg := range args[2:] {
+			if arg == "wav" {
+				wav = true
+			} else {
+				options = append(options, arg)
+			}
+		}
+		scale, p, err := captureArgs(options)
+		if err != nil {
+			return err
+		}
+		if wav {
+			// the WAV file is named after the animation
+			if err := wavStart(strings.TrimSuffix(args[1], filepath.Ext(args[1])) + ".wav"); err != nil {
+				return err
+			}
+		}
+		captureRecorder = &captureRecording{path: args[1], scale: scale, palette: p, wav: wav}
+
+	case "stop":
+		r := captureRecorder
+		if r == nil {
+			return errors.New("not recording")
+		}
+		captureRecorder = nil
+		// the animation is written before the WAV file so that an error of
+		// the latter does not lose it, and the WAV recording is left alone if
+		// it was stopped already
+		err := captureWrite(r)
+		if r.wav && wavRecorder != nil {
+			if wavErr := wavStop(); err == nil {
+				err = wavErr
+			}
+		}
+		return err
+
+	default:
+		return fmt.Errorf("invalid record command %s", args[0])
+	}
+	return nil
+}
+
+// captureScreenshot writes the display to a PNG or PBM file.
+func captureScreenshot(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing file name")
+	}
+	scale, p, err := captureArgs(args[1:])
+	if err != nil {
+		return err
+	}
+
+	frame := captureFrame(filterOutput())
+	img := captureImage(&frame, scale, p)
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	switch strings.ToLower(filepath.Ext(args[0])) {
+	case ".pbm":
+		// binary portable bitmap, lit pixels are black as on paper,
+		// rows are padded to a byte; pixels at least half as bright as
+		// the foreground are lit
+		fmt.Fprintf(w, "P4\n%d %d\n", img.Rect.Dx(), img.Rect.Dy())
+		row := make([]byte, (img.Rect.Dx()+7)/8)
+		for y := 0; y < img.Rect.Dy(); y++ {
+			for i := range row {
+				row[i] = 0
+			}
+			for x := 0; x < img.Rect.Dx(); x++ {
+				if img.ColorIndexAt(x, y) >= FILTERLEVELS/2 {
+					row[x/8] |= 0x80 >> (x % 8)
+				}
+			}
+			w.Write(row)
+		}
+	default:
+		err = png.Encode(w, img)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// captureWrite writes a recording to its file as an animated GIF or PNG.
+func captureWrite(r *captureRecording) error {
+	if len(r.runs) == 0 {
+		return errors.New("no frame was recorded")
+	}
+
+	file, err := os.Create(r.path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if strings.ToLower(filepath.Ext(r.path)) == ".gif" {
+		err = captureEncodeGIF(w, r.runs, r.scale, r.palette)
+	} else {
+		err = captureEncodeAPNG(w, r.runs, r.scale, r.palette)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fmt.Printf("Recorded %d frames (%.2fs) to %s\n", r.ticks, float64(r.ticks)/60, r.path)
+	return file.Close()
+}
@@ -0,0 +1,986 @@
+package main
+
+// Octo cartridges
+//
+// Octo shares programs as GIF images, cartridges, showing a label and
+// carrying the program in their pixels: the two low bits of the color index
+// of every pixel, frame after frame, row after row, make up the payload, four
+// pixels per byte, most significant bits first. The payload is a 32 bits
+// big-endian length followed by a JSON object holding the source of the
+// program and the options of the Octo emulator:
+//
+//	{"program": ": main ...", "options": {"tickrate": 20, "shiftQuirks": true, ...}}
+//
+// Cartridges are loaded like any other program. The source is compiled by a
+// subset of Octo: labels (": name"), :const, :alias, :call, :macro, :calc,
+// :byte, :org, :next, :unpack, numbers compiled as bytes, names of labels
+// compiled as calls, jump, jump0, return (or ;), clear, the assignments and
+// operators of the registers, i, delay and buzzer, sprite, bcd, save, load,
+// "if ... then", "if ... begin ... else ... end" and "loop ... while ...
+// again". Other statements, XO-CHIP ones included, are reported with their
+// line; programs using them have to be exported as binaries from Octo.
+// Loading was only checked against cartridges written by the cartridge
+// command, not against cartridges produced by Octo itself.
+// The options are applied to the quirks, the instructions per frame and the
+// colors; Octo options without an equivalent here are ignored.
+//
+// The cartridge command writes the program and the current settings as a
+// cartridge, the program being written as bytes in the Octo source and the
+// label showing the display.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	CARTRIDGEWIDTH  = 2 * SCREENWIDTH
+	CARTRIDGEHEIGHT = 2 * SCREENHEIGHT
+)
+
+// cartridgeOptions are the Octo options used by this interpreter.
+type cartridgeOptions struct {
+	Tickrate        int    `json:"tickrate,omitempty"`
+	FillColor       string `json:"fillColor,omitempty"`
+	BackgroundColor string `json:"backgroundColor,omitempty"`
+	ShiftQuirks     bool   `json:"shiftQuirks"`
+	LoadStoreQuirks bool   `json:"loadStoreQuirks"` // I is not incremented
+	JumpQuirks      bool   `json:"jumpQuirks"`
+	ClipQuirks      bool   `json:"clipQuirks"`
+	LogicQuirks     bool   `json:"logicQuirks"`
+}
+
+type cartridge struct {
+	Program string            `json:"program"`
+	Options *cartridgeOptions `json:"options"`
+}
+
+// cartridgeAssembler is the state of a pass of cartridgeAssemble.
+type cartridgeAssembler struct {
+	tokens    []string
+	lines     []int // source line of every token
+	next      int
+	pass      int
+	image     []byte
+	here      int // offset in the image of the next statement
+	labels    map[string]int
+	constants map[string]int
+	aliases   map[string]byte
+	macros    map[string]*cartridgeMacro
+	flow      []cartridgeFlow
+}
+
+// cartridgeFlow is a block of structured control flow being compiled: an if
+// begin or else block, or a loop, with the jumps to its end to patch.
+type cartridgeFlow struct {
+	kind    string // begin, else or loop
+	address int    // start of a loop
+	jumps   []int  // offsets of the jumps to the end in the image
+}
+
+// cartridgeMacro is a macro defined by :macro, expanded where its name is
+// found, its arguments being replaced by the tokens following the name.
+type cartridgeMacro struct {
+	args  []string
+	body  []string
+	calls int
+}
+
+var cartridgeLabel = regexp.MustCompile(`^[^\s#:;]+$`)
+
+// cartridgeAddress returns the address of a label, a constant or a number.
+// Labels defined later are unknown during the first pass.
+func cartridgeAddress(a *cartridgeAssembler, name string) (uint16, error) {
+	if address, ok := a.labels[name]; ok {
+		return uint16(address), nil
+	}
+	n, err := cartridgeValue(a, name)
+	if err != nil || n < 0 || n > 0xfff {
+		if a.pass == 0 && err != nil {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("unknown label %s", name)
+	}
+	return uint16(n), nil
+}
+
+// cartridgeApply applies the options of a cartridge to the machine and the
+// display.
+func cartridgeApply(options *cartridgeOptions) error {
+	m.quirks = quirks{
+		vfReset:  options.LogicQuirks,
+		memory:   !options.LoadStoreQuirks,
+		shift:    options.ShiftQuirks,
+		jumping:  options.JumpQuirks,
+		clipping: options.ClipQuirks,
+	}
+	if options.Tickrate != 0 {
+		if err := ipfSet(strconv.Itoa(options.Tickrate)); err != nil {
+			return err
+		}
+	}
+	if options.FillColor != "" {
+		if err := displaySet("fg", options.FillColor); err != nil {
+			return err
+		}
+	}
+	if options.BackgroundColor != "" {
+		if err := displaySet("bg", options.BackgroundColor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cartridgeAssemble compiles the subset of Octo described above into an
+// image loaded at 0x200. Errors tell the line of the statement.
+func cartridgeAssemble(source string) ([]byte, error) {
+	tokens, lines := []string{}, []int{}
+	for n, line := range strings.Split(source, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, token := range strings.Fields(line) {
+			tokens, lines = append(tokens, token), append(lines, n+1)
+		}
+	}
+
+	// the first pass finds the labels, the second one compiles, every
+	// statement having the same size in both
+	labels := make(map[string]int)
+	var a *cartridgeAssembler
+	for pass := 0; pass < 2; pass++ {
+		a = &cartridgeAssembler{
+			// macros are expanded in place
+			tokens:    append([]string{}, tokens...),
+			lines:     append([]int{}, lines...),
+			pass:      pass,
+			image:     []byte{},
+			labels:    labels,
+			constants: make(map[string]int),
+			aliases:   make(map[string]byte),
+			macros:    make(map[string]*cartridgeMacro),
+		}
+		for a.next < len(a.tokens) {
+			line := a.lines[a.next]
+			if err := cartridgeStatement(a); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		if len(a.flow) > 0 {
+			return nil, fmt.Errorf("missing %s", map[string]string{"begin": "end", "else": "end", "loop": "again"}[a.flow[len(a.flow)-1].kind])
+		}
+	}
+	return a.image, nil
+}
+
+// cartridgeAssignment compiles the statements on a register vx.
+func cartridgeAssignment(a *cartridgeAssembler, x uint16) error {
+	operator, operand := cartridgeToken(a), cartridgeToken(a)
+	registers := map[string]uint16{":=": 0x0, "|=": 0x1, "&=": 0x2, "^=": 0x3, "+=": 0x4, "-=": 0x5, ">>=": 0x6, "=-": 0x7, "<<=": 0xe}
+	if y, err := cartridgeRegister(a, operand); err == nil {
+		if n, ok := registers[operator]; ok {
+			cartridgeEmit(a, 0x8000|x<<8|y<<4|n)
+			return nil
+		}
+		return fmt.Errorf("unsupported operator %s", operator)
+	}
+
+	switch {
+	case operator == ":=" && operand == "random":
+		n, err := cartridgeByte(a, cartridgeToken(a))
+		if err != nil {
+			return err
+		}
+		cartridgeEmit(a, 0xc000|x<<8|n)
+	case operator == ":=" && operand == "delay":
+		cartridgeEmit(a, 0xf007|x<<8)
+	case operator == ":=" && operand == "key":
+		cartridgeEmit(a, 0xf00a|x<<8)
+	case operator == ":=" || operator == "+=" || operator == "-=":
+		n, err := cartridgeByte(a, operand)
+		if err != nil {
+			return err
+		}
+		switch operator {
+		case ":=":
+			cartridgeEmit(a, 0x6000|x<<8|n)
+		case "+=":
+			cartridgeEmit(a, 0x7000|x<<8|n)
+		case "-=":
+			cartridgeEmit(a, 0x7000|x<<8|-n&0xff)
+		}
+	default:
+		return fmt.Errorf("unsupported operator %s", operator)
+	}
+	return nil
+}
+
+// cartridgeBool returns 1 if b is true, 0 otherwise, like the comparisons of
+// Octo expressions.
+func cartridgeBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// cartridgeByte returns the value of a byte operand, negative numbers being
+// written in two's complement.
+func cartridgeByte(a *cartridgeAssembler, token string) (uint16, error) {
+	n, err := cartridgeValue(a, token)
+	if err != nil {
+		return 0, err
+	}
+	if n < -128 || n > 0xff {
+		return 0, fmt.Errorf("byte %s out of range", token)
+	}
+	return uint16(n) & 0xff, nil
+}
+
+// cartridgeCalc evaluates the expression at the start of terms and returns
+// the terms following it.
+func cartridgeCalc(a *cartridgeAssembler, terms []string) (int, []string, error) {
+	if len(terms) == 0 {
+		return 0, nil, errors.New("missing operand in expression")
+	}
+
+	var n int
+	var err error
+	term, terms := terms[0], terms[1:]
+	switch term {
+	case "(":
+		if n, terms, err = cartridgeCalc(a, terms); err != nil {
+			return 0, nil, err
+		}
+		if len(terms) == 0 || terms[0] != ")" {
+			return 0, nil, errors.New("missing ) in expression")
+		}
+		terms = terms[1:]
+	case "-", "~", "!", "abs", "sign":
+		if n, terms, err = cartridgeCalc(a, terms); err != nil {
+			return 0, nil, err
+		}
+		// unary operators apply to the whole expression on their right
+		switch term {
+		case "-":
+			n = -n
+		case "~":
+			n = ^n
+		case "!":
+			n = cartridgeBool(n == 0)
+		case "abs":
+			if n < 0 {
+				n = -n
+			}
+		case "sign":
+			n = cartridgeBool(n > 0) - cartridgeBool(n < 0)
+		}
+		return n, terms, nil
+	default:
+		if n, err = cartridgeTerm(a, term); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if len(terms) == 0 || terms[0] == ")" {
+		return n, terms, nil
+	}
+	operator := terms[0]
+	rhs, terms, err := cartridgeCalc(a, terms[1:])
+	if err != nil {
+		return 0, nil, err
+	}
+	switch operator {
+	case "+":
+		n += rhs
+	case "-":
+		n -= rhs
+	case "*":
+		n *= rhs
+	case "/", "%":
+		if rhs == 0 {
+			return 0, nil, errors.New("division by zero in expression")
+		}
+		if operator == "/" {
+			n /= rhs
+		} else {
+			n %= rhs
+		}
+	case "&":
+		n &= rhs
+	case "|":
+		n |= rhs
+	case "^":
+		n ^= rhs
+	case "<<", ">>":
+		if rhs < 0 || rhs > 31 {
+			return 0, nil, fmt.Errorf("invalid shift %d in expression", rhs)
+		}
+		if operator == "<<" {
+			n <<= rhs
+		} else {
+			n >>= rhs
+		}
+	case "pow":
+		p := 1
+		for ; rhs > 0; rhs-- {
+			p *= n
+		}
+		n = p
+	case "min":
+		if rhs < n {
+			n = rhs
+		}
+	case "max":
+		if rhs > n {
+			n = rhs
+		}
+	case "<":
+		n = cartridgeBool(n < rhs)
+	case "<=":
+		n = cartridgeBool(n <= rhs)
+	case ">":
+		n = cartridgeBool(n > rhs)
+	case ">=":
+		n = cartridgeBool(n >= rhs)
+	case "==":
+		n = cartridgeBool(n == rhs)
+	case "!=":
+		n = cartridgeBool(n != rhs)
+	default:
+		return 0, nil, fmt.Errorf("unsupported operator %s in expression", operator)
+	}
+	return n, terms, nil
+}
+
+// cartridgeCommand writes the program, from 0x200 to the last non-zero
+// instruction, and the current settings as a cartridge.
+func cartridgeCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing file name")
+	}
+	end := MEMEND
+	for end > MEMPROGRAMSTART && m.memory[end-1] == 0 {
+		end--
+	}
+	end += (end - MEMPROGRAMSTART) % 2
+
+	c := cartridge{
+		Program: cartridgeSource(m.memory[MEMPROGRAMSTART:end]),
+		Options: &cartridgeOptions{
+			Tickrate:        m.ipf,
+			FillColor:       strings.ToUpper(paletteFormatColor(displayPalette.foreground)),
+			BackgroundColor: strings.ToUpper(paletteFormatColor(displayPalette.background)),
+			ShiftQuirks:     m.quirks.shift,
+			LoadStoreQuirks: !m.quirks.memory,
+			JumpQuirks:      m.quirks.jumping,
+			ClipQuirks:      m.quirks.clipping,
+			LogicQuirks:     m.quirks.vfReset,
+		},
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(file, cartridgeEncode(payload)); err != nil {
+		file.Close()
+		return err
+	}
+	fmt.Printf("Wrote %d bytes of program to %s\n", end-MEMPROGRAMSTART, args[0])
+	return file.Close()
+}
+
+// cartridgeCondition compiles the condition of if and while statements. It
+// returns the instruction skipping the next one unless the condition holds,
+// and the one skipping it if the condition holds.
+func cartridgeCondition(a *cartridgeAssembler) (uint16, uint16, error) {
+	x, err := cartridgeRegister(a, cartridgeToken(a))
+	if err != nil {
+		return 0, 0, err
+	}
+	operator := cartridgeToken(a)
+	switch operator {
+	case "key":
+		return 0xe0a1 | x<<8, 0xe09e | x<<8, nil
+	case "-key":
+		return 0xe09e | x<<8, 0xe0a1 | x<<8, nil
+	case "==", "!=":
+	default:
+		return 0, 0, fmt.Errorf("unsupported condition %s", operator)
+	}
+
+	operand := cartridgeToken(a)
+	var equal, different uint16
+	if y, err := cartridgeRegister(a, operand); err == nil {
+		equal, different = 0x9000|x<<8|y<<4, 0x5000|x<<8|y<<4
+	} else {
+		n, err := cartridgeByte(a, operand)
+		if err != nil {
+			return 0, 0, err
+		}
+		equal, different = 0x4000|x<<8|n, 0x3000|x<<8|n
+	}
+	if operator == "!=" {
+		return different, equal, nil
+	}
+	return equal, different, nil
+}
+
+// cartridgeDecode returns the image and the options of a cartridge.
+func cartridgeDecode(data []byte) ([]byte, *cartridgeOptions, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload := []byte{}
+	var b byte
+	bits := 0
+	for _, frame := range g.Image {
+		r := frame.Rect
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				b = b<<2 | frame.ColorIndexAt(x, y)&3
+				if bits += 2; bits == 8 {
+					payload = append(payload, b)
+					b, bits = 0, 0
+				}
+			}
+		}
+	}
+	if len(payload) < 4 || int(binary.BigEndian.Uint32(payload)) > len(payload)-4 {
+		return nil, nil, errors.New("not an Octo cartridge")
+	}
+	payload = payload[4 : 4+binary.BigEndian.Uint32(payload)]
+
+	var c cartridge
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, nil, fmt.Errorf("invalid Octo cartridge: %v", err)
+	}
+	image, err := cartridgeAssemble(c.Program)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cartridge: %v", err)
+	}
+	return image, c.Options, nil
+}
+
+// cartridgeDefineMacro reads the definition of a macro following :macro:
+// its name, its arguments and its body between braces.
+func cartridgeDefineMacro(a *cartridgeAssembler) error {
+	name := cartridgeToken(a)
+	if !cartridgeLabelValid(name) {
+		return fmt.Errorf("invalid macro name %s", name)
+	}
+	macro := &cartridgeMacro{}
+	for token := cartridgeToken(a); token != "{"; token = cartridgeToken(a) {
+		if token == "" {
+			return fmt.Errorf("missing body of macro %s", name)
+		}
+		macro.args = append(macro.args, token)
+	}
+	for depth := 1; ; {
+		token := cartridgeToken(a)
+		switch token {
+		case "":
+			return fmt.Errorf("missing } after macro %s", name)
+		case "{":
+			depth++
+		case "}":
+			depth--
+		}
+		if depth == 0 {
+			break
+		}
+		macro.body = append(macro.body, token)
+	}
+	a.macros[name] = macro
+	return nil
+}
+
+// cartridgeEmit writes an instruction in the image and returns its offset.
+func cartridgeEmit(a *cartridgeAssembler, op uint16) int {
+	return cartridgeEmitBytes(a, byte(op>>8), byte(op))
+}
+
+// cartridgeEmitBytes writes bytes in the image at the current offset, which
+// :org can move, and returns the offset of the first one.
+func cartridgeEmitBytes(a *cartridgeAssembler, data ...byte) int {
+	offset := a.here
+	if end := offset + len(data); end > len(a.image) {
+		a.image = append(a.image, make([]byte, end-len(a.image))...)
+	}
+	copy(a.image[offset:], data)
+	a.here += len(data)
+	return offset
+}
+
+// cartridgeEncode returns the frames carrying the payload, the label being
+// the display in four shades of the display palette, the low bits of the
+// color indexes holding the data.
+func cartridgeEncode(payload []byte) *gif.GIF {
+	data := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(len(payload)))
+	data = append(data, payload...)
+
+	colors := make(color.Palette, 16)
+	for index := range colors {
+		c := filterColor(uint8((index>>2)*5), displayPalette)
+		for _, channel := range []*uint8{&c.R, &c.G, &c.B} {
+			if *channel < 0x80 {
+				*channel += uint8(index & 3)
+			} else {
+				*channel -= uint8(index & 3)
+			}
+		}
+		colors[index] = c
+	}
+
+	g := &gif.GIF{}
+	pixels := 4 * len(data)
+	for n := 0; n == 0 || n < pixels; {
+		frame := image.NewPaletted(image.Rect(0, 0, CARTRIDGEWIDTH, CARTRIDGEHEIGHT), colors)
+		for y := 0; y < CARTRIDGEHEIGHT; y++ {
+			for x := 0; x < CARTRIDGEWIDTH; x++ {
+				label := uint8(0)
+				if m.pixmap[x/2][y/2] != 0 {
+					label = 3
+				}
+				bits := uint8(0)
+				if n < pixels {
+					bits = data[n/4] >> (6 - 2*(n%4)) & 3
+				}
+				frame.SetColorIndex(x, y, label<<2|bits)
+				n++
+			}
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 0)
+	}
+	return g
+}
+
+// cartridgeExpand replaces the invocation of a macro by its body, CALLS
+// being the number of previous invocations.
+func cartridgeExpand(a *cartridgeAssembler, macro *cartridgeMacro) error {
+	line := a.lines[a.next-1]
+	values := map[string]string{"CALLS": strconv.Itoa(macro.calls)}
+	for _, arg := range macro.args {
+		value := cartridgeToken(a)
+		if value == "" {
+			return fmt.Errorf("missing argument %s", arg)
+		}
+		values[arg] = value
+	}
+	macro.calls++
+
+	body := make([]string, len(macro.body))
+	lines := make([]int, len(macro.body))
+	for i, token := range macro.body {
+		if value, ok := values[token]; ok {
+			token = value
+		}
+		body[i], lines[i] = token, line
+	}
+	if len(a.tokens)+len(body) > 1<<20 {
+		return errors.New("too many macro expansions")
+	}
+	a.tokens = append(a.tokens[:a.next], append(body, a.tokens[a.next:]...)...)
+	a.lines = append(a.lines[:a.next], append(lines, a.lines[a.next:]...)...)
+	return nil
+}
+
+// cartridgeExpression returns the value of a number, a constant, a label or
+// an expression between braces like the ones of :calc. Expressions are
+// evaluated right to left, as Octo does, parentheses grouping terms. Octo
+// expressions are computed with floating point numbers, they are truncated
+// to integers here.
+func cartridgeExpression(a *cartridgeAssembler) (int, error) {
+	token := cartridgeToken(a)
+	if token != "{" {
+		return cartridgeTerm(a, token)
+	}
+	terms := []string{}
+	for token = cartridgeToken(a); token != "}"; token = cartridgeToken(a) {
+		if token == "" {
+			return 0, errors.New("missing }")
+		}
+		terms = append(terms, token)
+	}
+	n, rest, err := cartridgeCalc(a, terms)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("unexpected %s in expression", rest[0])
+	}
+	return n, err
+}
+
+// cartridgeLabelValid tells whether a label can be defined in Octo source,
+// main being reserved to the start of the program.
+func cartridgeLabelValid(name string) bool {
+	if _, err := cartridgeNumber(name); err == nil || name == "main" {
+		return false
+	}
+	return cartridgeLabel.MatchString(name)
+}
+
+// cartridgeNumber parses an Octo number: decimal, 0x hexadecimal or 0b
+// binary, possibly negative.
+func cartridgeNumber(s string) (int, error) {
+	digits := strings.TrimPrefix(s, "-")
+	base := 10
+	switch {
+	case strings.HasPrefix(digits, "0x"):
+		digits, base = digits[2:], 16
+	case strings.HasPrefix(digits, "0b"):
+		digits, base = digits[2:], 2
+	}
+	n, err := strconv.ParseUint(digits, base, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %s", s)
+	}
+	if strings.HasPrefix(s, "-") {
+		return -int(n), nil
+	}
+	return int(n), nil
+}
+
+// cartridgePatch makes the jumps at offsets of the image go to the current
+// address.
+func cartridgePatch(a *cartridgeAssembler, jumps []int) {
+	address := MEMPROGRAMSTART + a.here
+	for _, offset := range jumps {
+		a.image[offset] = byte(0x10 | address>>8)
+		a.image[offset+1] = byte(address)
+	}
+}
+
+// cartridgeRegister returns the number of a register, v0 to vf or an alias.
+func cartridgeRegister(a *cartridgeAssembler, name string) (uint16, error) {
+	if x, ok := a.aliases[name]; ok {
+		return uint16(x), nil
+	}
+	if len(name) == 2 && (name[0] == 'v' || name[0] == 'V') {
+		if x, err := strconv.ParseUint(name[1:], 16, 4); err == nil {
+			return uint16(x), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid register %s", name)
+}
+
+// cartridgeSource returns the Octo source of an image, made of bytes, with
+// the labels of the symbols that Octo accepts.
+func cartridgeSource(image []byte) string {
+	var source strings.Builder
+	source.WriteString(": main")
+	for i, b := range image {
+		address := uint16(MEMPROGRAMSTART + i)
+		if label, ok := symbolsLabel(address); ok && i != 0 && cartridgeLabelValid(label) {
+			fmt.Fprintf(&source, "\n: %s\n\t", label)
+		} else if i%16 == 0 {
+			source.WriteString("\n\t")
+		} else {
+			source.WriteString(" ")
+		}
+		fmt.Fprintf(&source, "0x%02X", b)
+	}
+	source.WriteString("\n")
+	return source.String()
+}
+
+// cartridgeStatement compiles the statement starting at the next token.
+func cartridgeStatement(a *cartridgeAssembler) error {
+	address := MEMPROGRAMSTART + a.here
+	token := cartridgeToken(a)
+	emit := func(op uint16) error {
+		cartridgeEmit(a, op)
+		return nil
+	}
+	target := func(op uint16) error {
+		nnn, err := cartridgeAddress(a, cartridgeToken(a))
+		if err != nil {
+			return err
+		}
+		return emit(op | nnn)
+	}
+
+	switch token {
+	case ":":
+		name := cartridgeToken(a)
+		if !cartridgeLabelValid(name) && name != "main" {
+			return fmt.Errorf("invalid label %s", name)
+		}
+		if name == "main" && a.here != 0 {
+			return errors.New("main must start the program")
+		}
+		a.labels[name] = address
+		return nil
+
+	case ":const":
+		name, value := cartridgeToken(a), cartridgeToken(a)
+		n, err := cartridgeValue(a, value)
+		if err != nil {
+			return err
+		}
+		a.constants[name] = n
+		return nil
+
+	case ":alias":
+		name := cartridgeToken(a)
+		x, err := cartridgeRegister(a, cartridgeToken(a))
+		if err != nil {
+			return err
+		}
+		a.aliases[name] = byte(x)
+		return nil
+
+	case ":calc":
+		name := cartridgeToken(a)
+		n, err := cartridgeExpression(a)
+		if err != nil {
+			return err
+		}
+		a.constants[name] = n
+		return nil
+
+	case ":byte":
+		n, err := cartridgeExpression(a)
+		if err != nil {
+			return err
+		}
+		if n < -128 || n > 0xff {
+			return fmt.Errorf("byte %d out of range", n)
+		}
+		cartridgeEmitBytes(a, byte(n))
+		return nil
+
+	case ":org":
+		n, err := cartridgeExpression(a)
+		if err != nil {
+			return err
+		}
+		if n < MEMPROGRAMSTART || n >= MEMEND {
+			return fmt.Errorf("address 0x%x out of the program memory", n)
+		}
+		a.here = n - MEMPROGRAMSTART
+		return nil
+
+	case ":next":
+		// the label is the second byte of the next instruction, for self
+		// modifying code
+		name := cartridgeToken(a)
+		if !cartridgeLabelValid(name) {
+			return fmt.Errorf("invalid label %s", name)
+		}
+		a.labels[name] = address + 1
+		return nil
+
+	case ":unpack":
+		nibble, err := cartridgeValue(a, cartridgeToken(a))
+		if err != nil || nibble < 0 || nibble > 0xf {
+			return errors.New("invalid :unpack nibble")
+		}
+		nnn, err := cartridgeAddress(a, cartridgeToken(a))
+		if err != nil {
+			return err
+		}
+		cartridgeEmit(a, 0x6000|uint16(nibble)<<4|nnn>>8)
+		return emit(0x6100 | nnn&0xff)
+
+	case ":macro":
+		return cartridgeDefineMacro(a)
+
+	case ":call":
+		return target(0x2000)
+	case "jump":
+		return target(0x1000)
+	case "jump0":
+		return target(0xb000)
+	case "return", ";":
+		return emit(0x00ee)
+	case "clear":
+		return emit(0x00e0)
+
+	case "if":
+		then, otherwise, err := cartridgeCondition(a)
+		if err != nil {
+			return err
+		}
+		switch cartridgeToken(a) {
+		case "then":
+			return emit(then)
+		case "begin":
+			cartridgeEmit(a, otherwise)
+			a.flow = append(a.flow, cartridgeFlow{kind: "begin", jumps: []int{cartridgeEmit(a, 0x1000)}})
+			return nil
+		}
+		return errors.New("missing then or begin")
+
+	case "else", "end":
+		if len(a.flow) == 0 || a.flow[len(a.flow)-1].kind == "loop" || (token == "else" && a.flow[len(a.flow)-1].kind == "else") {
+			return fmt.Errorf("unexpected %s", token)
+		}
+		top := &a.flow[len(a.flow)-1]
+		if token == "else" {
+			jump := cartridgeEmit(a, 0x1000)
+			cartridgePatch(a, top.jumps)
+			*top = cartridgeFlow{kind: "else", jumps: []int{jump}}
+			return nil
+		}
+		cartridgePatch(a, top.jumps)
+		a.flow = a.flow[:len(a.flow)-1]
+		return nil
+
+	case "loop":
+		a.flow = append(a.flow, cartridgeFlow{kind: "loop", address: address})
+		return nil
+
+	case "while":
+		if len(a.flow) == 0 || a.flow[len(a.flow)-1].kind != "loop" {
+			return errors.New("while outside of a loop")
+		}
+		_, otherwise, err := cartridgeCondition(a)
+		if err != nil {
+			return err
+		}
+		cartridgeEmit(a, otherwise)
+		top := &a.flow[len(a.flow)-1]
+		top.jumps = append(top.jumps, cartridgeEmit(a, 0x1000))
+		return nil
+
+	case "again":
+		if len(a.flow) == 0 || a.flow[len(a.flow)-1].kind != "loop" {
+			return errors.New("again without loop")
+		}
+		top := a.flow[len(a.flow)-1]
+		cartridgeEmit(a, 0x1000|uint16(top.address))
+		cartridgePatch(a, top.jumps)
+		a.flow = a.flow[:len(a.flow)-1]
+		return nil
+
+	case "i":
+		switch operator, operand := cartridgeToken(a), cartridgeToken(a); {
+		case operator == ":=" && operand == "hex":
+			x, err := cartridgeRegister(a, cartridgeToken(a))
+			if err != nil {
+				return err
+			}
+			return emit(0xf029 | x<<8)
+		case operator == ":=":
+			nnn, err := cartridgeAddress(a, operand)
+			if err != nil {
+				return err
+			}
+			return emit(0xa000 | nnn)
+		case operator == "+=":
+			x, err := cartridgeRegister(a, operand)
+			if err != nil {
+				return err
+			}
+			return emit(0xf01e | x<<8)
+		}
+		return errors.New("unsupported statement on i")
+
+	case "delay", "buzzer":
+		if cartridgeToken(a) != ":=" {
+			return fmt.Errorf("missing := after %s", token)
+		}
+		x, err := cartridgeRegister(a, cartridgeToken(a))
+		if err != nil {
+			return err
+		}
+		return emit(map[string]uint16{"delay": 0xf015, "buzzer": 0xf018}[token] | x<<8)
+
+	case "sprite":
+		x, err := cartridgeRegister(a, cartridgeToken(a))
+		if err != nil {
+			return err
+		}
+		y, err := cartridgeRegister(a, cartridgeToken(a))
+		if err != nil {
+			return err
+		}
+		n, err := cartridgeValue(a, cartridgeToken(a))
+		if err != nil || n < 0 || n > 0xf {
+			return errors.New("invalid sprite height")
+		}
+		return emit(0xd000 | x<<8 | y<<4 | uint16(n))
+
+	case "bcd", "save", "load":
+		x, err := cartridgeRegister(a, cartridgeToken(a))
+		if err != nil {
+			return err
+		}
+		return emit(map[string]uint16{"bcd": 0xf033, "save": 0xf055, "load": 0xf065}[token] | x<<8)
+	}
+
+	if macro, ok := a.macros[token]; ok {
+		return cartridgeExpand(a, macro)
+	}
+	if x, err := cartridgeRegister(a, token); err == nil {
+		return cartridgeAssignment(a, x)
+	}
+	if _, err := cartridgeValue(a, token); err == nil {
+		n, err := cartridgeByte(a, token)
+		if err != nil {
+			return err
+		}
+		cartridgeEmitBytes(a, byte(n))
+		return nil
+	}
+	// the name of a label calls it
+	if _, ok := a.labels[token]; (!ok && a.pass == 1) || strings.HasPrefix(token, ":") {
+		return fmt.Errorf("unsupported Octo statement %s", token)
+	}
+	nnn, _ := cartridgeAddress(a, token)
+	return emit(0x2000 | nnn)
+}
+
+// cartridgeTerm returns the value of a term of an expression: a number, a
+// constant, a label or HERE, the address of the next statement. Labels
+// defined later are worth 0 during the first pass.
+func cartridgeTerm(a *cartridgeAssembler, token string) (int, error) {
+	if token == "HERE" {
+		return MEMPROGRAMSTART + a.here, nil
+	}
+	if address, ok := a.labels[token]; ok {
+		return address, nil
+	}
+	n, err := cartridgeValue(a, token)
+	if err != nil && a.pass == 0 && cartridgeLabelValid(token) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// cartridgeToken returns the next token of the source, or an empty string at
+// its end.
+func cartridgeToken(a *cartridgeAssembler) string {
+	if a.next >= len(a.tokens) {
+		return ""
+	}
+	a.next++
+	return a.tokens[a.next-1]
+}
+
+// cartridgeValue returns the value of a number or a constant.
+func cartridgeValue(a *cartridgeAssembler, token string) (int, error) {
+	if n, ok := a.constants[token]; ok {
+		return n, nil
+	}
+	return cartridgeNumber(token)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/gif"
+	"strings"
+	"testing"
+)
+
+func TestCartridgeAssemble(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		image  []byte
+	}{
+		{"bytes", ": main 1 0x2 0b11 -1", []byte{0x01, 0x02, 0x03, 0xff}},
+		{"labels", ": main jump l1 : l1 l1 ; i := l1 jump0 main",
+			[]byte{0x12, 0x02, 0x22, 0x02, 0x00, 0xee, 0xa2, 0x02, 0xb2, 0x00}},
+		{"registers", ": main v0 := 5 v1 += v2 v3 -= 1 va := random 0x0f vb =- vc vf <<= v0",
+			[]byte{0x60, 0x05, 0x81, 0x24, 0x73, 0xff, 0xca, 0x0f, 0x8b, 0xc7, 0x8f, 0x0e}},
+		{"if then", ": main if v1 == 5 then clear if v1 != v2 then return if v3 key then clear",
+			[]byte{0x41, 0x05, 0x00, 0xe0, 0x51, 0x20, 0x00, 0xee, 0xe3, 0xa1, 0x00, 0xe0}},
+		{"if begin else end", ": main if v0 == 1 begin clear else return end",
+			[]byte{0x30, 0x01, 0x12, 0x08, 0x00, 0xe0, 0x12, 0x0a, 0x00, 0xee}},
+		{"loop while again", ": main loop while v0 != 3 v0 += 1 again",
+			[]byte{0x40, 0x03, 0x12, 0x08, 0x70, 0x01, 0x12, 0x00}},
+		{"const alias", ":const SPEED 3 :alias px v4 : main px += SPEED", []byte{0x74, 0x03}},
+		{"calc", ":const W 8 :calc H { W * ( 2 + 1 ) } : main :byte H :byte { H >> 1 } :byte { 10 - 2 - 1 }",
+			[]byte{24, 12, 9}},
+		{"macro", ":macro twice reg { reg += 1 reg += 1 } : main twice v2 twice v3",
+			[]byte{0x72, 0x01, 0x72, 0x01, 0x73, 0x01, 0x73, 0x01}},
+		{"macro calls", ":macro count { :byte CALLS } : main count count count", []byte{0, 1, 2}},
+		{"org", ": main jump end :org 0x206 : end return", []byte{0x12, 0x06, 0, 0, 0, 0, 0x00, 0xee}},
+		{"next", ": main :next target v0 := 1 i := target", []byte{0x60, 0x01, 0xa2, 0x01}},
+		{"unpack", ": main :unpack 0xa data : data 7", []byte{0x60, 0xa2, 0x61, 0x04, 0x07}},
+		{"disassembler", ": main i := 0x20A sprite va vb 6 :call 0x2F0 if v0 -key then v0 := key bcd v1 load v2",
+			[]byte{0xa2, 0x0a, 0xda, 0xb6, 0x22, 0xf0, 0xe0, 0x9e, 0xf0, 0x0a, 0xf1, 0x33, 0xf2, 0x65}},
+	}
+	for _, test := range tests {
+		image, err := cartridgeAssemble(test.source)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(image, test.image) {
+			t.Errorf("%s: got % x, expected % x", test.name, image, test.image)
+		}
+	}
+}
+
+func TestCartridgeAssembleErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{": main\n:stringmode x \"a\" { }", "line 2: unsupported Octo statement :stringmode"},
+		{": main\n\nfoo", "line 3: unsupported Octo statement foo"},
+		{": main plane 1", "line 1: unsupported Octo statement plane"},
+		{": main v0 := 256", "byte 256 out of range"},
+		{": main sprite v0 v1 16", "invalid sprite height"},
+		{": main loop", "missing again"},
+		{": main if v0 == 1 begin", "missing end"},
+		{": main end", "unexpected end"},
+		{": main :org 0x100", "out of the program memory"},
+		{": main :byte { 1 / 0 }", "division by zero"},
+		{":macro m { : main", "missing } after macro m"},
+		{": main 1 : main", "main must start the program"},
+	}
+	for _, test := range tests {
+		_, err := cartridgeAssemble(test.source)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, expected %q", test.source, err, test.err)
+		}
+	}
+}
+
+func TestCartridgeRoundTrip(t *testing.T) {
+	program := []byte{0x6a, 0x02, 0xa2, 0x0a, 0xda, 0xb6, 0x12, 0x00, 0x80, 0xff}
+	payload, err := json.Marshal(cartridge{
+		Program: cartridgeSource(program),
+		Options: &cartridgeOptions{Tickrate: 15, ShiftQuirks: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encoded bytes.Buffer
+	if err := gif.EncodeAll(&encoded, cartridgeEncode(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	image, options, err := cartridgeDecode(encoded.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(image, program) {
+		t.Errorf("got % x, expected % x", image, program)
+	}
+	if options.Tickrate != 15 || !options.ShiftQuirks || options.JumpQuirks {
+		t.Errorf("got options %+v", *options)
+	}
+
+	// a truncated cartridge is rejected
+	if _, _, err := cartridgeDecode(encoded.Bytes()[:len(encoded.Bytes())/2]); err == nil {
+		t.Error("truncated cartridge accepted")
+	}
+}
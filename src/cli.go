@@ -2,17 +2,269 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	PROMPT = "chip> "
+	RCFILE = ".chip8rc"
 )
 
+// cliScriptDepth counts the scripts currently being executed. When commands
+// come from a script, run blocks until the machine reaches a breakpoint so
+// the following commands see the machine stopped.
+var cliScriptDepth int
+
+// cliTimeout bounds how long a scripted run waits for a breakpoint.
+var cliTimeout = 10 * time.Second
+
+// cliBatchCommand is a command given with -ex, or the path of a script
+// given with -x when script is set.
+type cliBatchCommand struct {
+	text   string
+	script bool
+}
+
+// cliQuit is returned by cliExecute when the user quits.
+var cliQuit = errors.New("quit")
+
+// cliSettings are the settings that the ROM database and the cartridges
+// change when a program is loaded.
+type cliSettings struct {
+	quirks  quirks
+	ipf     int
+	palette palette
+	filter  filterSettings
+	keys    map[string]byte
+	buttons map[string]byte
+}
+
+// cliDefaults are the settings given on the command line, restored before
+// another program is loaded so that it does not keep the settings of the
+// previous one. cliExplicit tells the options given explicitly, which
+// override the settings of the programs.
+var (
+	cliDefaults cliSettings
+	cliExplicit map[string]bool
+)
+
+// cliAssert evaluates a "<operand> <operator> <operand>" condition, operands
+// being anything understood by cliValue.
+func cliAssert(args []string) error {
+	if len(args) != 3 {
+		return errors.New("usage: assert <operand> <operator> <operand>")
+	}
+
+	lhs, err := cliValue(args[0])
+	if err != nil {
+		return err
+	}
+	rhs, err := cliValue(args[2])
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	switch args[1] {
+	case "==":
+		ok = lhs == rhs
+	case "!=":
+		ok = lhs != rhs
+	case "<":
+		ok = lhs < rhs
+	case "<=":
+		ok = lhs <= rhs
+	case ">":
+		ok = lhs > rhs
+	case ">=":
+		ok = lhs >= rhs
+	default:
+		return fmt.Errorf("invalid operator %s", args[1])
+	}
+
+	if !ok {
+		return fmt.Errorf("assertion failed: %s %s %s (0x%x %s 0x%x)", args[0], args[1], args[2], lhs, args[1], rhs)
+	}
+	return nil
+}
+
+// cliCommand executes a command on the emulation goroutine. The commands
+// waiting for the machine or for other commands are handled by cliExecute.
+func cliCommand(args []string) error {
+	switch args[0] {
+	case "asm":
+		return asmCommand(args[1:])
+
+	case "assert":
+		return cliAssert(args[1:])
+
+	case "b", "break":
+		if len(args) < 2 {
+			return errors.New("missing address")
+		}
+		address, err := cliParseNumber(args[1])
+		if err != nil || address%2 != 0 || address < 0x200 || address >= 0x1000 {
+			return errors.New("invalid address")
+		}
+		machineAddBreakpoint(address)
+
+	case "bp", "breakpoints":
+		breakpoints := machineListBreakpoints()
+		for i := 0; i < len(breakpoints); i++ {
+			fmt.Printf("Breakpoint #%d: 0x%03x\n", i+1, breakpoints[i])
+		}
+
+	case "cartridge":
+		return cartridgeCommand(args[1:])
+
+	case "cl", "clear":
+		machineClearBreakpoints()
+
+	case "del", "delete":
+		if len(args) < 2 {
+			return errors.New("missing breakpoint id")
+		}
+		id, _ := strconv.ParseInt(args[1], 10, 0)
+		machineDeleteBreakpoint(int(id))
+
+	case "cov", "coverage":
+		return coverageCommand(args[1:])
+
+	case "d", "disassemble":
+		base := m.regs.pc
+		count := 10
+		var err error
+		if len(args) > 2 {
+			if base, err = cliParseNumber(args[1]); err != nil {
+				return err
+			}
+			count, err = strconv.Atoi(args[2])
+		} else if len(args) > 1 {
+			count, err = strconv.Atoi(args[1])
+		}
+		if err != nil {
+			return errors.New("invalid count")
+		}
+		cliDisassemble(base, count)
+
+	case "disasm":
+		return disasmCommand(args[1:])
+
+	case "display":
+		return displayCommand(args[1:])
+
+	case "filter":
+		return filterCommand(args[1:])
+
+	case "h", "help":
+		cliShowHelp()
+
+	case "info":
+		return infoCommand(args[1:])
+
+	case "ipf":
+		return ipfCommand(args[1:])
+
+	case "ips":
+		return ipsCommand(args[1:])
+
+	case "k", "kill":
+		machineStop()
+
+	case "keymap":
+		return keymapCommand(args[1:])
+
+	case "listing":
+		return listingCommand(args[1:])
+
+	case "load":
+		if len(args) < 2 {
+			return errors.New("missing file name")
+		}
+		return cliLoad(args[1], len(args) > 2 && args[2] == "keep")
+
+	case "p", "pixmap":
+		cliShowPixmap()
+
+	case "poke":
+		if len(args) < 3 {
+			return errors.New("missing address or bytes")
+		}
+		address, err := cliParseNumber(args[1])
+		if err != nil || int(address)+len(args)-2 > MEMEND {
+			return errors.New("invalid address")
+		}
+		values := []byte{}
+		for _, arg := range args[2:] {
+			value, err := cliParseNumber(arg)
+			if err != nil || value > 0xff {
+				return fmt.Errorf("invalid byte %s", arg)
+			}
+			values = append(values, byte(value))
+		}
+		copy(m.memory[address:], values)
+
+	case "profile":
+		return profileCommand(args[1:])
+
+	case "quirks":
+		return quirksCommand(args[1:])
+
+	case "r", "regs":
+		cliShowRegs()
+
+	case "record":
+		return captureRecord(args[1:])
+
+	case "re", "reset":
+		machineReset()
+
+	case "ru", "run":
+		if m.running {
+			return errors.New("machine is already running")
+		}
+		machineRun()
+
+	case "sound":
+		return audioCommand(args[1:])
+
+	case "sprite":
+		return spriteCommand(args[1:])
+
+	case "sprites":
+		return spritesCommand(args[1:])
+
+	case "s", "step":
+		if m.running {
+			return errors.New("machine is running, cannot step it")
+		}
+		machineStep()
+
+	case "screenshot":
+		return captureScreenshot(args[1:])
+
+	case "wav":
+		return wavCommand(args[1:])
+
+	case "xref":
+		return xrefCommand(args[1:])
+
+	case "write-rom":
+		return cliWriteRom(args[1:])
+
+	default:
+		return fmt.Errorf("%s: unrecognized command", args[0])
+	}
+	return nil
+}
+
 func cliDisassemble(base uint16, count int) {
 	for i := 0; i < count; i++ {
 		address := base + uint16(i*2)
@@ -22,27 +274,283 @@ func cliDisassemble(base uint16, count int) {
 	}
 }
 
-func cliExit() {
-	fmt.Println()
-	os.Exit(0)
+// cliExecute runs a line of commands separated by semicolons. Execution
+// stops at the first command returning an error, cliQuit for exit and quit.
+func cliExecute(input string) error {
+	for _, command := range strings.Split(input, ";") {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			continue
+		}
+
+		var err error
+		switch args[0] {
+		case "e", "exit", "q", "quit":
+			return cliQuit
+
+		case "so", "source":
+			if len(args) < 2 {
+				return errors.New("missing file name")
+			}
+			err = cliSource(args[1])
+
+		case "ru", "run":
+			// scripts wait for the machine to reach a breakpoint
+			if cliScriptDepth > 0 {
+				err = cliRunUntilBreakpoint()
+				break
+			}
+			fallthrough
+
+		default:
+			machineDo(func() {
+				err = cliCommand(args)
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cliLoad replaces the program by another one and resets the machine,
+// forgetting the breakpoints, symbols, coverage map, profile and sprites of
+// the previous program unless keep is set. The -patch patch, meant for the
+// program given on the command line, is not applied.
+func cliLoad(path string, keep bool) error {
+	return cliLoadFrom(path, keep, func() error {
+		return machineLoadProgram(path, "")
+	})
+}
+
+// cliLoadFrom is cliLoad with the program loaded by load, path being the
+// file it comes from, or empty, for its keymap file.
+func cliLoadFrom(path string, keep bool, load func() error) error {
+	machineStop()
+
+	// the symbols of an annotated listing replace the current ones while
+	// loading, the previous symbols and settings being restored if the load
+	// fails
+	previous, settings := symbols, cliSaveSettings()
+	if !keep {
+		symbolsClear()
+	}
+	cliRestoreSettings(cliDefaults)
+	if err := load(); err != nil {
+		symbols = previous
+		cliRestoreSettings(settings)
+		return err
+	}
+
+	cliOverrideSettings()
+	if err := keymapLoadFiles(path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	// the asm patches are undone with the bytes of the previous program
+	asmPatches = nil
+	if !keep {
+		machineClearBreakpoints()
+		coverage = [MEMEND]byte{}
+		profileReset()
+		spriteLog = make(map[spriteKey]uint64)
+	}
+	machineReset()
+	return nil
+}
+
+// cliOverrideSettings applies the settings given explicitly on the command
+// line over the ones of the program.
+func cliOverrideSettings() {
+	if cliExplicit["quirks"] {
+		m.quirks = cliDefaults.quirks
+	}
+	if cliExplicit["ipf"] {
+		m.ipf = cliDefaults.ipf
+	}
+	if cliExplicit["palette"] {
+		displayPalette = cliDefaults.palette
+	}
+	if cliExplicit["fg"] {
+		displayPalette.foreground = cliDefaults.palette.foreground
+	}
+	if cliExplicit["bg"] {
+		displayPalette.background = cliDefaults.palette.background
+	}
+	displayChanged()
+}
+
+// cliRestoreSettings restores settings returned by cliSaveSettings.
+func cliRestoreSettings(settings cliSettings) {
+	m.quirks = settings.quirks
+	m.ipf = settings.ipf
+	displayPalette = settings.palette
+	if filter != settings.filter {
+		filter = settings.filter
+		filterReset()
+	}
+	keymap.keys = make(map[string]byte)
+	for key, k := range settings.keys {
+		keymap.keys[key] = k
+	}
+	keymap.buttons = make(map[string]byte)
+	for button, k := range settings.buttons {
+		keymap.buttons[button] = k
+	}
+	displayChanged()
+}
+
+// cliSaveSettings returns the current settings.
+func cliSaveSettings() cliSettings {
+	settings := cliSettings{
+		quirks:  m.quirks,
+		ipf:     m.ipf,
+		palette: displayPalette,
+		filter:  filter,
+		keys:    make(map[string]byte),
+		buttons: make(map[string]byte),
+	}
+	for key, k := range keymap.keys {
+		settings.keys[key] = k
+	}
+	for button, k := range keymap.buttons {
+		settings.buttons[button] = k
+	}
+	return settings
 }
 
 func cliShowHelp() {
 	fmt.Println(`Available commands:
 e[xit] or q[uit]                quit the interpreter
 h[elp]                          show this message
-
-ru[n]                           run the machine
+so[urce] <file>                 execute the commands stored in file
+assert <a> <op> <b>             fail unless the comparison holds, a and b being
+                                registers (v0-vf, i, pc, sp, dt, st), memory
+                                bytes ([address]) or numbers, op one of
+                                ==, !=, <, <=, >, >=
+
+ru[n]                           run the machine (in scripts, wait until a
+                                breakpoint is reached)
 s[tep]                          step machine
 k[ill]                          stop machine run
 re[set]                         reset the machine
+load <file> [keep]              load another program and reset the machine,
+                                keeping the breakpoints, symbols and analyses
+                                of the previous one with keep
+write-rom <file> [start] [end]  write memory from start (default 0x200) to end
+                                (default the last non-zero instruction) as a
+                                binary program
 
 d[isassemble]                   disassemble the next 10 instructions
 d[isassemble] <count>           disassemble the next count instructions
 d[isassemble] <address> <count> disassemble the next count instructions, starting at address
+                                (bytes only used as data according to the
+                                coverage map are shown as DB)
+xref [address|label]            list the jumps, calls and LD I referencing
+                                address, found by following the program and
+                                in the coverage map, or every reference
+disasm                          show the disassembler settings
+disasm syntax <name>            disassemble in the cowgod (default), octo or
+                                chipper syntax
+disasm symbols on|off           show the addresses that have a label as the
+                                label (default on)
+disasm hints on|off             show the registers used by the instruction at
+                                PC and their values (default off)
+cartridge <file>                write the program and the current quirks,
+                                instructions per frame and colors as an Octo
+                                cartridge (.gif)
+asm <address> <instruction>     assemble an instruction, written in the cowgod
+                                syntax of the disassembler, at address
+asm [undo]                      list the patches made by asm, or undo the
+                                latest one
+listing <file> [start] [end]    write memory from start (default 0x200) to end
+                                (default the last non-zero byte) as an
+                                annotated listing that can be loaded again
 
 r[egs]                          show registers
+poke <address> <byte>...        write bytes to memory
+ips <file>                      write the changes made to the program in
+                                memory since it was loaded as an IPS patch
 p[ixmap]                        show the display pixmap
+display                         show the display settings
+display scale <n>               set the size of a pixel in the SDL window
+display scaling <filter>        scale the SDL window with the nearest, linear
+                                or best filter
+display palette <name>          use a palette (bw, green, amber, vip, hp48)
+display fg|bg <#rrggbb>         set the color of lit or unlit pixels
+display fullscreen [on|off]     switch fullscreen on or off, or toggle it
+filter                          show the display filters
+filter blend [frames]           blend the last frames (default 3)
+filter decay [factor]           dim unlit pixels progressively, keeping factor
+                                (default 0.5) of their brightness every frame
+filter hold on|off              keep pixels lit one more frame once erased
+filter none                     remove the filters
+screenshot <file> [scale] [palette]
+                                write the display to a .png or .pbm file, scale
+                                defaults to 8 and palette to the display one
+record start <file> [scale] [palette] [wav]
+                                record the display, one frame per 60Hz tick,
+                                and with wav, the sound to a .wav file of the
+                                same name
+record stop                     stop recording and write the .gif or .png
+                                (APNG) file
+wav start <file>                record the sound of the beeper
+wav stop                        stop recording and write the .wav file
+
+sound                           show the beeper settings
+sound on|off                    unmute or mute the beeper
+sound wave square|sine          set the waveform of the beeper
+sound pitch <Hz>                set the pitch of the beeper (default 440)
+sound volume <0-100>            set the volume of the beeper (default 25)
+
+sprite [address] [height] [ascii|blocks]
+                                show the sprite at address (default I), as #
+                                and . characters or as half blocks; the height
+                                defaults to the one last used by DRW
+sprite font <digit> [ascii|blocks]
+                                show the font sprite of a hex digit
+sprites [list]                  list the sprites drawn so far
+sprites reset                   forget the sprites drawn so far
+sprites png <file> [scale]      write the sprites drawn so far as a sprite sheet
+
+profile start|stop|reset         start, stop or reset the execution profiler
+profile [show [count]]          show the count (default 10) hottest addresses
+                                and subroutines, the opcodes histogram and the
+                                instructions per frame
+profile report <file>           write the full profile and the annotated
+                                disassembly to file
+
+cov[erage] [show]               show how many bytes were executed, drawn as
+                                sprites, read or written
+cov[erage] reset                forget the coverage map
+cov[erage] save <file>          save the coverage map as JSON
+cov[erage] load <file>          merge a saved coverage map with the current one
+cov[erage] png <file> [scale]   draw the coverage map as a 64x64 grid of bytes
+
+keymap                          show the keys and game controller buttons
+                                mapped to the keypad
+keymap layout <name>            map the keypad to the keys of the qwerty,
+                                azerty, qwertz or dvorak layout
+keymap key <key> <hex>|none     map a key (q, space, up, keypad8...) to a
+                                keypad key, or unmap it
+keymap pad <button> <hex>|none  map a game controller button (a, b, x, y,
+                                start, dpup, leftshoulder...) to a keypad key
+keymap load <file>              execute the keymap commands of a file
+
+info                            show the ROM database entry of the program
+info set <field> <value>        set a field of the entry in ~/.chip8db.json:
+                                title, author, platform, description, ipf,
+                                quirks (comma separated), palette, foreground,
+                                background or filter (filter commands
+                                separated by commas, e.g. decay 0.5,hold on)
+info key <key> <hex>|none       set the key mapping of the entry
+info save                       record the current quirks, instructions per
+                                frame, colors and filter in the entry
+quirks                          show the quirks of the interpreter
+quirks <name> on|off            set a quirk: vfreset, memory, shift, jumping
+                                or clipping
+quirks default                  restore the default quirks
+ipf [count]                     show or set the instructions per frame
 
 b[reak] <address>               set a new breakpoint at address
 b[reak]p[oints]                 show breakpoints
@@ -78,244 +586,224 @@ func cliShowRegs() {
 	fmt.Printf("[V%X] 0x%02x                 [SP%X] 0x%03x\n", 0xf, m.regs.v[0xf], 0xf, m.stack[0xf])
 }
 
-func cliPrintInstruction(address uint16) {
-	assembled := machineGetInstruction(address)
-	disassembled := machineDisassembleInstruction(assembled)
-
-	fmt.Printf("0x%03x: 0x%04x ", address, assembled)
-	switch {
-	case disassembled.op == sys:
-		fmt.Printf("SYS")
-
-	case disassembled.op == cls:
-		fmt.Printf("SYS")
-
-	case disassembled.op == ret:
-		fmt.Printf("RET")
-
-	case disassembled.op == jmp:
-		fmt.Printf("JMP 0x%03x", disassembled.nnn)
-
-	case disassembled.op == call:
-		fmt.Printf("CALL 0x%03x", disassembled.nnn)
-
-	case disassembled.op == seb:
-		fmt.Printf("SE V%X, 0x%02x", disassembled.x, disassembled.kk)
-
-	case disassembled.op == sneb:
-		fmt.Printf("SNE V%X, 0x%02x", disassembled.x, disassembled.kk)
-
-	case disassembled.op == ser:
-		fmt.Printf("SE V%X, V%X", disassembled.x, disassembled.y)
-
-	case disassembled.op == ldb:
-		fmt.Printf("LD V%X, 0x%02x", disassembled.x, disassembled.kk)
-
-	case disassembled.op == addb:
-		fmt.Printf("ADD V%X, 0x%02x", disassembled.x, disassembled.kk)
-
-	case disassembled.op == ldr:
-		fmt.Printf("LD V%X, V%X", disassembled.x, disassembled.y)
-
-	case disassembled.op == or:
-		fmt.Printf("OR V%X, V%X", disassembled.x, disassembled.y)
-
-	case disassembled.op == and:
-		fmt.Printf("AND V%X, V%X", disassembled.x, disassembled.y)
-
-	case disassembled.op == xor:
-		fmt.Printf("XOR V%X, V%X", disassembled.x, disassembled.y)
-
-	case disassembled.op == addr:
-		fmt.Printf("ADD V%X, V%X", disassembled.x, disassembled.y)
-
-	case disassembled.op == sub:
-		fmt.Printf("SUB V%X, V%X", disassembled.x, disassembled.y)
-
-	case disassembled.op == shr:
-		fmt.Printf("SHR V%X {, V%X}", disassembled.x, disassembled.y)
-
-	case disassembled.op == subn:
-		fmt.Printf("SUBN V%X, V%X", disassembled.x, disassembled.y)
-
-	case disassembled.op == shl:
-		fmt.Printf("SHL V%X {, V%X}", disassembled.x, disassembled.y)
-
-	case disassembled.op == sner:
-		fmt.Printf("SNE V%X, V%X", disassembled.x, disassembled.y)
-
-	case disassembled.op == ldi:
-		fmt.Printf("LD I, 0x%03x", disassembled.nnn)
-
-	case disassembled.op == jpv:
-		fmt.Printf("JP V0, 0x%03x", disassembled.nnn)
+// cliParseNumber accepts hexadecimal numbers prefixed with 0x and decimal
+// numbers.
+func cliParseNumber(s string) (uint16, error) {
+	base := 10
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+		base = 16
+	}
+	n, err := strconv.ParseUint(s, base, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %s", s)
+	}
+	return uint16(n), nil
+}
 
-	case disassembled.op == rnd:
-		fmt.Printf("RND V%X, 0x%02x", disassembled.x, disassembled.kk)
+// cliPrintInstruction prints the instruction at address.
+func cliPrintInstruction(address uint16) {
+	fmt.Println(disasmLine(address))
+}
 
-	case disassembled.op == drw:
-		fmt.Printf("DRW V%X, V%X, 0x%x", disassembled.x, disassembled.y, disassembled.n)
+// cliRun reads and executes commands until the user quits or the end of
+// the input.
+func cliRun(input io.Reader) {
+	fmt.Println("Type \"h\" or \"help\" for commands usage")
 
-	case disassembled.op == skp:
-		fmt.Printf("SKP V%X", disassembled.x)
+	reader := bufio.NewReader(input)
 
-	case disassembled.op == sknp:
-		fmt.Printf("SKNP V%X", disassembled.x)
+	for {
+		fmt.Printf(PROMPT)
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				fmt.Println()
+				return
+			}
+			fmt.Fprintln(os.Stderr, err)
+		}
 
-	case disassembled.op == gett:
-		fmt.Printf("LD V%X, DT", disassembled.x)
+		if err := cliExecute(input); err == cliQuit {
+			fmt.Println()
+			return
+		} else if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
 
-	case disassembled.op == ldk:
-		fmt.Printf("LD V%X, K", disassembled.x)
+// cliRunBatch executes commands non-interactively and returns the process
+// exit code: 0 if every command succeeded, 1 as soon as one fails.
+func cliRunBatch(commands []cliBatchCommand) int {
+	cliScriptDepth++
+	defer func() { cliScriptDepth-- }()
+
+	for _, command := range commands {
+		// the path of a script is used as is, spaces included
+		execute := cliExecute
+		if command.script {
+			execute = cliSource
+		}
+		if err := execute(command.text); err == cliQuit {
+			return 0
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return 0
+}
 
-	case disassembled.op == sett:
-		fmt.Printf("LD DT, V%X", disassembled.x)
+// cliRunUntilBreakpoint is the blocking flavour of run used by scripts. It
+// fails if the machine runs for longer than cliTimeout without reaching a
+// breakpoint.
+func cliRunUntilBreakpoint() error {
+	var stopped <-chan bool
+	var err error
+	machineDo(func() {
+		if m.running {
+			err = errors.New("machine is already running")
+			return
+		}
+		stopped = machineRun()
+	})
+	if err != nil {
+		return err
+	}
 
-	case disassembled.op == lds:
-		fmt.Printf("LD ST, V%X", disassembled.x)
+	select {
+	case hit := <-stopped:
+		if !hit {
+			return errors.New("machine stopped before reaching a breakpoint")
+		}
+	case <-time.After(cliTimeout):
+		machineDo(machineStop)
+		<-stopped
+		return fmt.Errorf("no breakpoint hit after %v", cliTimeout)
+	}
+	return nil
+}
 
-	case disassembled.op == addi:
-		fmt.Printf("ADD I, V%X", disassembled.x)
+// cliSource executes the commands stored in a file, one line at a time.
+// Empty lines and lines starting with # are ignored.
+func cliSource(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-	case disassembled.op == ldf:
-		fmt.Printf("LD F, V%X", disassembled.x)
+	cliScriptDepth++
+	defer func() { cliScriptDepth-- }()
 
-	case disassembled.op == ldbcd:
-		fmt.Printf("LD B, V%X", disassembled.x)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		input := strings.TrimSpace(scanner.Text())
+		if input == "" || strings.HasPrefix(input, "#") {
+			continue
+		}
+		if err := cliExecute(input); err == cliQuit {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
 
-	case disassembled.op == save:
-		fmt.Printf("LD [I], V%X", disassembled.x)
+// cliSourceInit executes ~/.chip8rc if it exists, then the commands for
+// the program unless it is empty, stored next to it with the same name and
+// the .chip8rc extension (pong.ch8 has its commands in pong.chip8rc). It
+// returns cliQuit if a script quits.
+func cliSourceInit(program string) error {
+	paths := []string{}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, RCFILE))
+	}
+	if program != "" {
+		paths = append(paths, strings.TrimSuffix(program, filepath.Ext(program))+RCFILE)
+	}
 
-	case disassembled.op == restore:
-		fmt.Printf("LD V%X, [I]", disassembled.x)
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := cliSource(path); err == cliQuit {
+			return err
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
 	}
-	fmt.Printf("\n")
+	return nil
 }
 
-func cliRun(buzz chan struct{}, draw chan struct{}) {
-	fmt.Println("Type \"h\" or \"help\" for commands usage")
-
-	reader := bufio.NewReader(os.Stdin)
-	stop := make(chan struct{}, 1)
+// cliValue returns the value of a register (v0 to vf, i, pc, sp, dt, st), of
+// a memory byte ([address]) or of a number.
+func cliValue(operand string) (uint16, error) {
+	name := strings.ToLower(operand)
 
-	for {
-		fmt.Printf(PROMPT)
-		input, err := reader.ReadString('\n')
+	switch {
+	case name == "i":
+		return m.regs.i, nil
+	case name == "pc":
+		return m.regs.pc, nil
+	case name == "sp":
+		return uint16(m.regs.sp), nil
+	case name == "dt":
+		return uint16(m.regs.dt), nil
+	case name == "st":
+		return uint16(m.regs.st), nil
+	case len(name) == 2 && name[0] == 'v':
+		x, err := strconv.ParseUint(name[1:], 16, 4)
 		if err != nil {
-			if err == io.EOF {
-				cliExit()
-			}
-			fmt.Fprintln(os.Stderr, err)
+			return 0, fmt.Errorf("invalid register %s", operand)
 		}
-		input = strings.TrimSuffix(input, "\n")
-
-		// FIXME: command is not properly parsed if there
-		// are spaces
-		// for instance s;d 1;r
-		// but s ; d 1 ; r is not
-		for _, command := range strings.Split(input, ";") {
-			args := strings.Split(command, " ")
-
-			switch args[0] {
-			case "b", "break":
-				if len(args) > 1 {
-					var address uint16
-					if strings.HasPrefix(args[1], "0x") || strings.HasPrefix(args[1], "0X") {
-						i, _ := strconv.ParseInt(args[1][2:], 16, 16)
-						address = uint16(i)
-					} else {
-						i, _ := strconv.ParseInt(args[1], 10, 16)
-						address = uint16(i)
-					}
-
-					if address%2 == 0 && address >= 0x200 && address < 0x1000 {
-						machineAddBreakpoint(address)
-					} else {
-						fmt.Printf("Invalid address\n")
-					}
-				} else {
-					fmt.Printf("Missing address\n")
-				}
-
-			case "bp", "breakpoints":
-				breakpoints := machineListBreakpoints()
-				for i := 0; i < len(breakpoints); i++ {
-					fmt.Printf("Breakpoint #%d: 0x%03x\n", i+1, breakpoints[i])
-				}
-
-			case "cl", "clear":
-				machineClearBreakpoints()
-
-			case "del", "delete":
-				if len(args) > 1 {
-					id, _ := strconv.ParseInt(args[1], 10, 0)
-					machineDeleteBreakpoint(int(id))
-				} else {
-					fmt.Printf("Missing breakpoint id\n")
-				}
-
-			case "d", "disassemble":
-				base := m.regs.pc
-				count := 10
-				if len(args) > 2 {
-					count, _ = strconv.Atoi(args[2])
-					if strings.HasPrefix(args[1], "0x") || strings.HasPrefix(args[2], "0X") {
-						i, _ := strconv.ParseInt(args[1][2:], 16, 16)
-						base = uint16(i)
-					} else {
-						i, _ := strconv.ParseInt(args[1], 10, 16)
-						base = uint16(i)
-					}
-				} else if len(args) > 1 {
-					count, _ = strconv.Atoi(args[1])
-				}
-				cliDisassemble(base, count)
-
-			case "e", "exit":
-				cliExit()
-
-			case "h", "help":
-				cliShowHelp()
-
-			case "k", "kill":
-				if machineIsRunning() {
-					stop <- struct{}{}
-				}
-
-			case "p", "pixmap":
-				cliShowPixmap()
-
-			case "q", "quit":
-				cliExit()
-
-			case "r", "regs":
-				cliShowRegs()
-
-			case "re", "reset":
-				if machineIsRunning() {
-					stop <- struct{}{}
-				}
-				machineReset()
-				buzz <- struct{}{}
-				draw <- struct{}{}
-
-			case "ru", "run":
-				if machineIsRunning() {
-					fmt.Printf("Machine is already running.\n")
-				} else {
-					go machineRun(buzz, draw, stop)
-				}
-
-			case "s", "step":
-				if machineIsRunning() {
-					fmt.Printf("Machine is running, cannot step it.\n")
-				} else {
-					machineStep(buzz, draw)
-				}
-
-			default:
-				fmt.Printf("%s: unrecognized command\n", args[0])
-			}
+		return uint16(m.regs.v[x]), nil
+	case strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]"):
+		address, err := cliParseNumber(name[1 : len(name)-1])
+		if err != nil || address >= MEMEND {
+			return 0, fmt.Errorf("invalid address %s", operand)
+		}
+		return uint16(m.memory[address]), nil
+	}
+	return cliParseNumber(operand)
+}
+
+// cliWriteRom writes memory as a binary program: write-rom <file> [start]
+// [end], the end defaulting to the last non-zero instruction.
+func cliWriteRom(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing file name")
+	}
+	start := uint16(MEMPROGRAMSTART)
+	var err error
+	if len(args) > 1 {
+		if start, err = cliParseNumber(args[1]); err != nil {
+			return err
+		}
+	}
+	end := uint16(MEMEND)
+	if start < end {
+		for end > start && m.memory[end-1] == 0 {
+			end--
 		}
+		if (end-start)%2 != 0 && end < MEMEND {
+			end++
+		}
+	}
+	if len(args) > 2 {
+		if end, err = cliParseNumber(args[2]); err != nil {
+			return err
+		}
+	}
+	if start >= MEMEND || end > MEMEND || end < start {
+		return errors.New("invalid address range")
+	}
+
+	if err := os.WriteFile(args[0], m.memory[start:end], 0644); err != nil {
+		return err
 	}
+	fmt.Printf("Wrote %d bytes (0x%03x-0x%03x) to %s\n", end-start, start, end, args[0])
+	return nil
 }
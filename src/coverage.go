@@ -0,0 +1,209 @@
+package main
+
+// Runtime code coverage and memory access map
+//
+// Every byte of the machine memory is tagged with the way the running
+// program accessed it: executed as an instruction, drawn as a sprite by DRW,
+// read by LD Vx, [I] or pointed at by LD F, Vx, written by LD [I], Vx or
+// LD B, Vx. Maps can be saved to JSON files and merged, so that coverage
+// accumulates across sessions.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	COVEXECUTED = 1 << iota
+	COVSPRITE
+	COVREAD
+	COVWRITTEN
+)
+
+var coverage [MEMEND]byte
+
+// coverageKinds names the tags, in the JSON files and in the disassembly.
+var coverageKinds = []struct {
+	flag  byte
+	name  string
+	color color.RGBA
+}{
+	{COVEXECUTED, "executed", color.RGBA{0x30, 0xc0, 0x30, 0xff}},
+	{COVSPRITE, "sprite", color.RGBA{0x30, 0x60, 0xff, 0xff}},
+	{COVREAD, "read", color.RGBA{0xf0, 0xd0, 0x20, 0xff}},
+	{COVWRITTEN, "written", color.RGBA{0xf0, 0x30, 0x30, 0xff}},
+}
+
+func coverageCommand(args []string) error {
+	if len(args) == 0 {
+		args = []string{"show"}
+	}
+
+	switch args[0] {
+	case "show":
+		for _, kind := range coverageKinds {
+			count := 0
+			for _, tags := range coverage {
+				if tags&kind.flag != 0 {
+					count++
+				}
+			}
+			fmt.Printf("%-8s %4d bytes\n", kind.name, count)
+		}
+
+	case "reset":
+		coverage = [MEMEND]byte{}
+
+	case "save":
+		if len(args) < 2 {
+			return errors.New("missing file name")
+		}
+		return coverageSave(args[1])
+
+	case "load":
+		if len(args) < 2 {
+			return errors.New("missing file name")
+		}
+		return coverageLoad(args[1])
+
+	case "png":
+		if len(args) < 2 {
+			return errors.New("missing file name")
+		}
+		scale := 8
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid scale %s", args[2])
+			}
+			scale = n
+		}
+		return coverageHeatmap(args[1], scale)
+
+	default:
+		return fmt.Errorf("invalid coverage command %s", args[0])
+	}
+	return nil
+}
+
+// coverageData tells if the word at address looks like data: none of its
+// bytes was executed and at least one of them was accessed as data. It
+// returns the kinds of accesses.
+func coverageData(address uint16) (string, bool) {
+	if int(address)+1 >= MEMEND {
+		return "", false
+	}
+	tags := coverage[address] | coverage[address+1]
+	if tags == 0 || tags&COVEXECUTED != 0 {
+		return "", false
+	}
+
+	kinds := make([]string, 0, len(coverageKinds))
+	for _, kind := range coverageKinds {
+		if tags&kind.flag != 0 {
+			kinds = append(kinds, kind.name)
+		}
+	}
+	return strings.Join(kinds, ", "), true
+}
+
+// coverageHeatmap draws the 4 KiB address space as a 64x64 grid, one cell
+// per byte and 64 bytes per row, each cell being scale pixels wide. The
+// color of a cell is the mix of the colors of its tags.
+func coverageHeatmap(path string, scale int) error {
+	img := image.NewRGBA(image.Rect(0, 0, 64*scale, 64*scale))
+	for address, tags := range coverage {
+		c := color.RGBA{0x20, 0x20, 0x20, 0xff}
+		if tags != 0 {
+			var r, g, b, n int
+			for _, kind := range coverageKinds {
+				if tags&kind.flag != 0 {
+					r, g, b, n = r+int(kind.color.R), g+int(kind.color.G), b+int(kind.color.B), n+1
+				}
+			}
+			c = color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), 0xff}
+		}
+
+		x0, y0 := (address%64)*scale, (address/64)*scale
+		for y := y0; y < y0+scale; y++ {
+			for x := x0; x < x0+scale; x++ {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// coverageLoad merges a map saved by coverageSave with the current one.
+func coverageLoad(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	ranges := make(map[string][][2]int)
+	if err := json.Unmarshal(data, &ranges); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, kind := range coverageKinds {
+		for _, r := range ranges[kind.name] {
+			if r[0] < 0 || r[1] >= MEMEND || r[0] > r[1] {
+				return fmt.Errorf("%s: invalid range %v", path, r)
+			}
+			for address := r[0]; address <= r[1]; address++ {
+				coverage[address] |= kind.flag
+			}
+		}
+	}
+	return nil
+}
+
+// coverageMark tags count bytes starting at address.
+func coverageMark(address uint16, count int, flag byte) {
+	for i := 0; i < count && int(address)+i < MEMEND; i++ {
+		coverage[int(address)+i] |= flag
+	}
+}
+
+// coverageSave writes the map as JSON, each kind of access being a list of
+// inclusive address ranges:
+// {"executed": [[512, 745]], "sprite": [[746, 752]], ...}
+func coverageSave(path string) error {
+	ranges := make(map[string][][2]int)
+	for _, kind := range coverageKinds {
+		ranges[kind.name] = [][2]int{}
+		start := -1
+		for address := 0; address <= MEMEND; address++ {
+			tagged := address < MEMEND && coverage[address]&kind.flag != 0
+			switch {
+			case tagged && start < 0:
+				start = address
+			case !tagged && start >= 0:
+				ranges[kind.name] = append(ranges[kind.name], [2]int{start, address - 1})
+				start = -1
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(ranges, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,659 @@
+package main
+
+// Debug Adapter Protocol server, see
+// https://microsoft.github.io/debug-adapter-protocol/specification
+//
+// The launch request accepts the following arguments:
+//   - program: path of the ROM to load (optional if given on the command line)
+//   - symbols: path of a symbol file, see symbols.go, its lines can be used to
+//     set breakpoints
+//   - stopOnEntry: stop before the first instruction
+//
+// There is a single thread. Stack frames are built from the program counter
+// and the return addresses stored in m.stack.
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DAPTHREAD    = 1
+	DAPREGISTERS = 1 // variables reference of the registers scope
+	DAPMEMORY    = 2 // variables reference of the memory scope
+	DAPMAXSTEPS  = 1000000
+	DAPSTEPCHUNK = 1000 // instructions of a long step executed per request
+)
+
+type dapObject map[string]interface{}
+
+type dapMessage struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command,omitempty"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	RequestSeq int             `json:"request_seq,omitempty"`
+	Success    *bool           `json:"success,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	Body       interface{}     `json:"body,omitempty"`
+}
+
+// dapSession holds the state of a connection with a DAP client. Requests are
+// handled on the emulation goroutine. Messages can be sent both by the
+// request loop and by the goroutine waiting for the machine to stop, hence
+// the mutex.
+type dapSession struct {
+	conn        net.Conn
+	lock        sync.Mutex
+	seq         int
+	stopOnEntry bool
+	breakpoints map[string][]uint16 // breakpoints set per source, or for instructions
+	step        *dapLongStep        // nil if no long step is in progress
+}
+
+// dapLongStep is a step executing a whole subroutine, see dapStepRest.
+type dapLongStep struct {
+	more func() bool // the step goes on while it returns true
+}
+
+type dapSource struct {
+	Path string `json:"path"`
+}
+
+// dapAfter sends the events following the successful response to a request.
+func dapAfter(s *dapSession, request dapMessage) {
+	switch request.Command {
+	case "initialize":
+		dapSendEvent(s, "initialized", nil)
+
+	case "configurationDone":
+		if s.stopOnEntry {
+			dapStopped(s, "entry")
+		} else {
+			dapContinue(s)
+		}
+
+	case "continue":
+		dapContinue(s)
+
+	case "next", "stepIn", "stepOut":
+		go dapStepRest(s)
+
+	case "disconnect", "terminate":
+		dapSendEvent(s, "terminated", nil)
+	}
+}
+
+func dapContinue(s *dapSession) {
+	var stopped <-chan bool
+	machineDo(func() {
+		stopped = machineRun()
+	})
+	go func() {
+		reason := "pause"
+		if <-stopped {
+			reason = "breakpoint"
+		}
+		dapStopped(s, reason)
+	}()
+}
+
+func dapDisassemble(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		MemoryReference   string `json:"memoryReference"`
+		Offset            int    `json:"offset"`
+		InstructionOffset int    `json:"instructionOffset"`
+		InstructionCount  int    `json:"instructionCount"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	base, err := cliParseNumber(args.MemoryReference)
+	if err != nil {
+		return nil, err
+	}
+
+	instructions := make([]dapObject, 0, args.InstructionCount)
+	start := int(base) + args.Offset + args.InstructionOffset*2
+	for i := 0; i < args.InstructionCount; i++ {
+		address := start + i*2
+		if address < 0 || address+1 >= MEMEND {
+			// the client expects exactly the count it asked for
+			instructions = append(instructions, dapObject{
+				"address":          fmt.Sprintf("0x%03x", address),
+				"instruction":      "",
+				"presentationHint": "invalid",
+			})
+			continue
+		}
+
+		instruction := dapObject{
+			"address":          fmt.Sprintf("0x%03x", address),
+			"instructionBytes": fmt.Sprintf("%04x", machineGetInstruction(uint16(address))),
+			"instruction":      disasmInstruction(uint16(address)),
+		}
+		if label, ok := symbolsLabel(uint16(address)); ok {
+			instruction["symbol"] = label
+		}
+		if line, ok := symbolsLine(uint16(address)); ok {
+			instruction["location"] = dapSource{symbols.source}
+			instruction["line"] = line
+		}
+		instructions = append(instructions, instruction)
+	}
+	return dapObject{"instructions": instructions}, nil
+}
+
+func dapEvaluate(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	value, err := cliValue(strings.TrimSpace(args.Expression))
+	if err != nil {
+		return nil, err
+	}
+	return dapObject{"result": fmt.Sprintf("0x%x", value), "variablesReference": 0}, nil
+}
+
+// dapHandle processes a request on the emulation goroutine and returns the
+// body of the response.
+func dapHandle(s *dapSession, request dapMessage) (interface{}, error) {
+	switch request.Command {
+	case "initialize":
+		return dapObject{
+			"supportsConfigurationDoneRequest": true,
+			"supportsDisassembleRequest":       true,
+			"supportsEvaluateForHovers":        true,
+			"supportsInstructionBreakpoints":   true,
+			"supportsReadMemoryRequest":        true,
+			"supportsSetVariable":              true,
+			"supportsSteppingGranularity":      true,
+		}, nil
+
+	case "launch":
+		return dapLaunch(s, request.Arguments)
+
+	case "setBreakpoints":
+		return dapSetBreakpoints(s, request.Arguments)
+
+	case "setInstructionBreakpoints":
+		return dapSetInstructionBreakpoints(s, request.Arguments)
+
+	case "configurationDone":
+		return nil, nil
+
+	case "threads":
+		return dapObject{"threads": []dapObject{{"id": DAPTHREAD, "name": "CHIP-8"}}}, nil
+
+	case "stackTrace":
+		return dapStackTrace(), nil
+
+	case "scopes":
+		return dapObject{"scopes": []dapObject{
+			{"name": "Registers", "presentationHint": "registers", "variablesReference": DAPREGISTERS, "expensive": false},
+			{"name": "Memory", "variablesReference": DAPMEMORY, "expensive": true},
+		}}, nil
+
+	case "variables":
+		return dapVariables(request.Arguments)
+
+	case "setVariable":
+		return dapSetVariable(request.Arguments)
+
+	case "evaluate":
+		return dapEvaluate(request.Arguments)
+
+	case "continue":
+		if m.running || s.step != nil {
+			return nil, errors.New("machine is already running")
+		}
+		return dapObject{"allThreadsContinued": true}, nil
+
+	case "pause":
+		machineStop()
+		s.step = nil
+		return nil, nil
+
+	case "next", "stepIn", "stepOut":
+		if m.running || s.step != nil {
+			return nil, errors.New("machine is running, cannot step it")
+		}
+		dapStep(s, request.Command)
+		return nil, nil
+
+	case "disassemble":
+		return dapDisassemble(request.Arguments)
+
+	case "readMemory":
+		return dapReadMemory(request.Arguments)
+
+	case "disconnect", "terminate":
+		machineStop()
+		s.step = nil
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unsupported request %s", request.Command)
+}
+
+func dapLaunch(s *dapSession, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Program     string `json:"program"`
+		Symbols     string `json:"symbols"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	if args.Program != "" {
+		if err := machineLoadProgram(args.Program, ""); err != nil {
+			return nil, err
+		}
+	}
+	if args.Symbols != "" {
+		if err := symbolsLoad(args.Symbols); err != nil {
+			return nil, err
+		}
+	}
+	machineReset()
+	s.stopOnEntry = args.StopOnEntry
+	return nil, nil
+}
+
+func dapReadMemory(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int    `json:"offset"`
+		Count           int    `json:"count"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	base, err := cliParseNumber(args.MemoryReference)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.Count < 0 {
+		return nil, errors.New("invalid count")
+	}
+	start := int(base) + args.Offset
+	end := start + args.Count
+	if start < 0 || start > MEMEND {
+		return nil, errors.New("invalid address")
+	}
+	if end > MEMEND {
+		end = MEMEND
+	}
+	return dapObject{
+		"address":         fmt.Sprintf("0x%03x", start),
+		"data":            base64.StdEncoding.EncodeToString(m.memory[start:end]),
+		"unreadableBytes": args.Count - (end - start),
+	}, nil
+}
+
+// dapReadMessage reads a message and its Content-Length header.
+func dapReadMessage(reader *textproto.Reader) (dapMessage, error) {
+	var message dapMessage
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return message, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return message, errors.New("invalid Content-Length header")
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader.R, data); err != nil {
+		return message, err
+	}
+	err = json.Unmarshal(data, &message)
+	return message, err
+}
+
+func dapSend(s *dapSession, message dapMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seq++
+	message.Seq = s.seq
+	data, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("dap: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.conn, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+func dapSendEvent(s *dapSession, event string, body interface{}) {
+	dapSend(s, dapMessage{Type: "event", Event: event, Body: body})
+}
+
+// dapServe listens for DAP clients on address and serves them one at a
+// time. It only returns if it cannot listen.
+func dapServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	fmt.Printf("Waiting for a DAP client on %s\n", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("DAP client connected from %s\n", conn.RemoteAddr())
+		dapSessionRun(&dapSession{
+			conn:        conn,
+			breakpoints: make(map[string][]uint16),
+		})
+		fmt.Printf("DAP client disconnected\n")
+	}
+}
+
+func dapSessionRun(s *dapSession) {
+	defer s.conn.Close()
+	reader := textproto.NewReader(bufio.NewReader(s.conn))
+
+	for {
+		request, err := dapReadMessage(reader)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("dap: %v\n", err)
+			}
+			return
+		}
+		if request.Type != "request" {
+			continue
+		}
+
+		var body interface{}
+		machineDo(func() {
+			body, err = dapHandle(s, request)
+		})
+		success := err == nil
+		response := dapMessage{
+			Type:       "response",
+			RequestSeq: request.Seq,
+			Command:    request.Command,
+			Success:    &success,
+			Body:       body,
+		}
+		if err != nil {
+			response.Message = err.Error()
+		}
+		dapSend(s, response)
+
+		if err == nil {
+			dapAfter(s, request)
+		}
+		if request.Command == "disconnect" || request.Command == "terminate" {
+			return
+		}
+	}
+}
+
+// dapSetBreakpointAddresses replaces the breakpoints previously set for key
+// by the ones at addresses.
+func dapSetBreakpointAddresses(s *dapSession, key string, addresses []uint16) {
+	for _, address := range s.breakpoints[key] {
+		machineDeleteBreakpointAt(address)
+	}
+	for _, address := range addresses {
+		machineAddBreakpoint(address)
+	}
+	s.breakpoints[key] = addresses
+}
+
+func dapSetBreakpoints(s *dapSession, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	path, err := filepath.Abs(args.Source.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	breakpoints := make([]dapObject, 0, len(args.Breakpoints))
+	addresses := make([]uint16, 0, len(args.Breakpoints))
+	for _, b := range args.Breakpoints {
+		if path != symbols.source {
+			breakpoints = append(breakpoints, dapObject{"verified": false, "line": b.Line, "message": "no symbols for this source"})
+			continue
+		}
+		address, line, ok := symbolsAddress(b.Line)
+		if !ok {
+			breakpoints = append(breakpoints, dapObject{"verified": false, "line": b.Line, "message": "no instruction at or after this line"})
+			continue
+		}
+		addresses = append(addresses, address)
+		breakpoints = append(breakpoints, dapObject{
+			"verified":             true,
+			"line":                 line,
+			"instructionReference": fmt.Sprintf("0x%03x", address),
+			"source":               dapSource{symbols.source},
+		})
+	}
+	dapSetBreakpointAddresses(s, path, addresses)
+	return dapObject{"breakpoints": breakpoints}, nil
+}
+
+func dapSetInstructionBreakpoints(s *dapSession, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Breakpoints []struct {
+			InstructionReference string `json:"instructionReference"`
+			Offset               int    `json:"offset"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	breakpoints := make([]dapObject, 0, len(args.Breakpoints))
+	addresses := make([]uint16, 0, len(args.Breakpoints))
+	for _, b := range args.Breakpoints {
+		base, err := cliParseNumber(b.InstructionReference)
+		address := int(base) + b.Offset
+		if err != nil || address < 0 || address >= MEMEND {
+			breakpoints = append(breakpoints, dapObject{"verified": false, "message": "invalid address"})
+			continue
+		}
+		addresses = append(addresses, uint16(address))
+		breakpoints = append(breakpoints, dapObject{"verified": true, "instructionReference": fmt.Sprintf("0x%03x", address)})
+	}
+	// instruction breakpoints are not tied to a source, "" cannot be a path
+	dapSetBreakpointAddresses(s, "", addresses)
+	return dapObject{"breakpoints": breakpoints}, nil
+}
+
+func dapSetVariable(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		VariablesReference int    `json:"variablesReference"`
+		Name               string `json:"name"`
+		Value              string `json:"value"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	if args.VariablesReference != DAPREGISTERS {
+		return nil, errors.New("only registers can be set")
+	}
+
+	value, err := cliParseNumber(strings.TrimSpace(args.Value))
+	if err != nil {
+		return nil, err
+	}
+	if err := machineSetRegister(args.Name, value); err != nil {
+		return nil, err
+	}
+	return dapObject{"value": fmt.Sprintf("0x%x", value)}, nil
+}
+
+// dapStackFrame describes the frame executing at address.
+func dapStackFrame(id int, address uint16) dapObject {
+	name := fmt.Sprintf("0x%03x", address)
+	if label, base, ok := symbolsNearest(address); ok {
+		name = label
+		if base != address {
+			name = fmt.Sprintf("%s+0x%x", label, address-base)
+		}
+	}
+
+	frame := dapObject{
+		"id":                          id,
+		"name":                        name,
+		"line":                        0,
+		"column":                      0,
+		"instructionPointerReference": fmt.Sprintf("0x%03x", address),
+	}
+	if line, ok := symbolsLine(address); ok {
+		frame["line"] = line
+		frame["source"] = dapSource{symbols.source}
+	}
+	return frame
+}
+
+func dapStackTrace() interface{} {
+	frames := []dapObject{dapStackFrame(0, m.regs.pc)}
+
+	// the stack grows downwards from 16, each entry being the address
+	// following a call instruction
+	for sp := int(m.regs.sp); sp < len(m.stack); sp++ {
+		frames = append(frames, dapStackFrame(len(frames), m.stack[sp]-2))
+	}
+	return dapObject{"stackFrames": frames, "totalFrames": len(frames)}
+}
+
+// dapStep executes a single instruction (stepIn), an instruction or a whole
+// subroutine call (next) or the rest of the current subroutine (stepOut).
+// Only the first instruction is executed here, dapStepRest executing the
+// rest of a whole subroutine.
+func dapStep(s *dapSession, command string) {
+	sp := m.regs.sp
+	instruction := machineDisassembleInstruction(machineGetInstruction(m.regs.pc))
+
+	machineStep()
+	switch {
+	case command == "next" && instruction.op == call:
+		s.step = &dapLongStep{func() bool {
+			return m.regs.sp < sp
+		}}
+	case command == "stepOut" && sp < 16:
+		s.step = &dapLongStep{func() bool {
+			return m.regs.sp <= sp
+		}}
+	}
+}
+
+// dapStepRest finishes the step started by dapStep, DAPSTEPCHUNK instructions
+// per request so that the emulation goroutine keeps running frames and
+// serving the other requests in between, and sends the stopped event. The
+// step stops at breakpoints, after DAPMAXSTEPS instructions or when paused
+// or run by another client.
+func dapStepRest(s *dapSession) {
+	var step *dapLongStep
+	machineDo(func() {
+		step = s.step
+	})
+	if step == nil {
+		dapStopped(s, "step")
+		return
+	}
+
+	reason := ""
+	for steps := 0; reason == ""; steps += DAPSTEPCHUNK {
+		machineDo(func() {
+			for i := 0; i < DAPSTEPCHUNK; i++ {
+				switch {
+				case s.step != step || m.running:
+					reason = "pause"
+				case !step.more() || steps+i >= DAPMAXSTEPS:
+					reason = "step"
+				default:
+					for _, address := range m.breakpoints {
+						if m.regs.pc == address {
+							reason = "breakpoint"
+						}
+					}
+				}
+				if reason != "" {
+					if s.step == step {
+						s.step = nil
+					}
+					return
+				}
+				machineStep()
+			}
+		})
+	}
+	dapStopped(s, reason)
+}
+
+func dapStopped(s *dapSession, reason string) {
+	dapSendEvent(s, "stopped", dapObject{"reason": reason, "threadId": DAPTHREAD, "allThreadsStopped": true})
+}
+
+func dapVariables(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	variables := []dapObject{}
+	variable := func(name string, value string) {
+		variables = append(variables, dapObject{"name": name, "value": value, "variablesReference": 0})
+	}
+
+	switch args.VariablesReference {
+	case DAPREGISTERS:
+		for x := 0; x < 16; x++ {
+			variable(fmt.Sprintf("V%X", x), fmt.Sprintf("0x%02x", m.regs.v[x]))
+		}
+		variable("I", fmt.Sprintf("0x%03x", m.regs.i))
+		variable("PC", fmt.Sprintf("0x%03x", m.regs.pc))
+		variable("SP", fmt.Sprintf("0x%02x", m.regs.sp))
+		variable("DT", fmt.Sprintf("0x%02x", m.regs.dt))
+		variable("ST", fmt.Sprintf("0x%02x", m.regs.st))
+
+	case DAPMEMORY:
+		for address := 0; address < MEMEND; address += 16 {
+			row := make([]string, 16)
+			for i := range row {
+				row[i] = fmt.Sprintf("%02x", m.memory[address+i])
+			}
+			variable(fmt.Sprintf("0x%03x", address), strings.Join(row, " "))
+		}
+
+	default:
+		return nil, errors.New("invalid variables reference")
+	}
+	return dapObject{"variables": variables}, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+// Disassembler
+//
+// Instructions are written in one of three syntaxes:
+//
+//	cowgod   the mnemonics of Cowgod's Chip-8 technical reference (default)
+//	octo     the statements of the Octo assembler
+//	chipper  the mnemonics of the CHIPPER assembler, numbers written #nnn
+//
+// Words that are not instructions are written as data, DW 0x1234 (bytes in
+// Octo). With symbols on, the addresses that have a label are written as the
+// label. With hints on, the instruction at PC is followed by the values of
+// the registers it uses, and their notes from the symbols, as Octo shows
+// them when a program is interrupted.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var disasm = struct {
+	syntax  string
+	symbols bool
+	hints   bool
+}{syntax: "cowgod", symbols: true}
+
+// disasmSyntax gives the templates of the instructions of a syntax, $x, $y,
+// $n, $kk and $nnn standing for the fields of the instruction, $hi and $lo
+// for its bytes and $word for the whole word, and the formats of the
+// registers and numbers.
+type disasmSyntax struct {
+	templates map[opcode]string
+	register  string
+	formats   map[string]string
+	comment   string
+}
+
+var disasmSyntaxes = map[string]*disasmSyntax{
+	"cowgod": {
+		templates: map[opcode]string{
+			sys: "SYS $nnn", cls: "CLS", ret: "RET", jmp: "JP $nnn", call: "CALL $nnn",
+			seb: "SE V$x, $kk", sneb: "SNE V$x, $kk", ser: "SE V$x, V$y",
+			ldb: "LD V$x, $kk", addb: "ADD V$x, $kk", ldr: "LD V$x, V$y",
+			or: "OR V$x, V$y", and: "AND V$x, V$y", xor: "XOR V$x, V$y",
+			addr: "ADD V$x, V$y", sub: "SUB V$x, V$y", shr: "SHR V$x {, V$y}",
+			subn: "SUBN V$x, V$y", shl: "SHL V$x {, V$y}", sner: "SNE V$x, V$y",
+			ldi: "LD I, $nnn", jpv: "JP V0, $nnn", rnd: "RND V$x, $kk",
+			drw: "DRW V$x, V$y, $n", skp: "SKP V$x", sknp: "SKNP V$x",
+			gett: "LD V$x, DT", ldk: "LD V$x, K", sett: "LD DT, V$x",
+			lds: "LD ST, V$x", addi: "ADD I, V$x", ldf: "LD F, V$x",
+			ldbcd: "LD B, V$x", save: "LD [I], V$x", restore: "LD V$x, [I]",
+			invalid: "DW $word",
+		},
+		register: "%X",
+		formats:  map[string]string{"$n": "0x%x", "$kk": "0x%02x", "$nnn": "0x%03x", "$word": "0x%04x"},
+		comment:  ";",
+	},
+	"octo": {
+		templates: map[opcode]string{
+			sys: "$hi $lo", cls: "clear", ret: "return", jmp: "jump $nnn", call: ":call $nnn",
+			seb: "if v$x != $kk then", sneb: "if v$x == $kk then", ser: "if v$x != v$y then",
+			ldb: "v$x := $kk", addb: "v$x += $kk", ldr: "v$x := v$y",
+			or: "v$x |= v$y", and: "v$x &= v$y", xor: "v$x ^= v$y",
+			addr: "v$x += v$y", sub: "v$x -= v$y", shr: "v$x >>= v$y",
+			subn: "v$x =- v$y", shl: "v$x <<= v$y", sner: "if v$x == v$y then",
+			ldi: "i := $nnn", jpv: "jump0 $nnn", rnd: "v$x := random $kk",
+			drw: "sprite v$x v$y $n", skp: "if v$x -key then", sknp: "if v$x key then",
+			gett: "v$x := delay", ldk: "v$x := key", sett: "delay := v$x",
+			lds: "buzzer := v$x", addi: "i += v$x", ldf: "i := hex v$x",
+			ldbcd: "bcd v$x", save: "save v$x", restore: "load v$x",
+			invalid: "$hi $lo",
+		},
+		register: "%x",
+		formats:  map[string]string{"$n": "%d", "$kk": "0x%02X", "$nnn": "0x%03X", "$word": "0x%04X"},
+		comment:  "#",
+	},
+	"chipper": {
+		templates: map[opcode]string{
+			sys: "SYS $nnn", cls: "CLS", ret: "RET", jmp: "JP $nnn", call: "CALL $nnn",
+			seb: "SE V$x, $kk", sneb: "SNE V$x, $kk", ser: "SE V$x, V$y",
+			ldb: "LD V$x, $kk", addb: "ADD V$x, $kk", ldr: "LD V$x, V$y",
+			or: "OR V$x, V$y", and: "AND V$x, V$y", xor: "XOR V$x, V$y",
+			addr: "ADD V$x, V$y", sub: "SUB V$x, V$y", shr: "SHR V$x",
+			subn: "SUBN V$x, V$y", shl: "SHL V$x", sner: "SNE V$x, V$y",
+			ldi: "LD I, $nnn", jpv: "JP V0, $nnn", rnd: "RND V$x, $kk",
+			drw: "DRW V$x, V$y, $n", skp: "SKP V$x", sknp: "SKNP V$x",
+			gett: "LD V$x, DT", ldk: "LD V$x, K", sett: "LD DT, V$x",
+			lds: "LD ST, V$x", addi: "ADD I, V$x", ldf: "LD F, V$x",
+			ldbcd: "LD B, V$x", save: "LD [I], V$x", restore: "LD V$x, [I]",
+			invalid: "DW $word",
+		},
+		register: "%X",
+		formats:  map[string]string{"$n": "#%X", "$kk": "#%02X", "$nnn": "#%03X", "$word": "#%04X"},
+		comment:  ";",
+	},
+}
+
+// disasmCommand shows the disassembler settings, or sets them: disasm
+// syntax cowgod|octo|chipper, disasm symbols on|off or disasm hints on|off.
+func disasmCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("syntax  %s\n", disasm.syntax)
+		fmt.Printf("symbols %t\n", disasm.symbols)
+		fmt.Printf("hints   %t\n", disasm.hints)
+		return nil
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("missing %s value", args[0])
+	}
+	return disasmSet(args[0], args[1])
+}
+
+// disasmData returns the bytes of the word at address written as data.
+func disasmData(address uint16) string {
+	return disasmFormatData(address, disasm.syntax)
+}
+
+// disasmFormat returns the instruction at address in a syntax.
+func disasmFormat(address uint16, name string) string {
+	syntax := disasmSyntaxes[name]
+	word := machineGetInstruction(address)
+	decoded := machineDisassembleInstruction(word)
+
+	nnn := fmt.Sprintf(syntax.formats["$nnn"], word&0xfff)
+	if label, ok := symbolsLabel(word & 0xfff); ok && disasm.symbols {
+		switch decoded.op {
+		case jmp, jpv, ldi:
+			nnn = label
+		case call:
+			if name == "octo" {
+				return label
+			}
+			nnn = label
+		}
+	}
+
+	return strings.NewReplacer(
+		"$nnn", nnn,
+		"$kk", fmt.Sprintf(syntax.formats["$kk"], decoded.kk),
+		"$n", fmt.Sprintf(syntax.formats["$n"], decoded.n),
+		"$x", fmt.Sprintf(syntax.register, decoded.x),
+		"$y", fmt.Sprintf(syntax.register, decoded.y),
+		"$hi", fmt.Sprintf("0x%02X", word>>8),
+		"$lo", fmt.Sprintf("0x%02X", word&0xff),
+		"$word", fmt.Sprintf(syntax.formats["$word"], word),
+	).Replace(syntax.templates[decoded.op])
+}
+
+// disasmFormatData returns the bytes of the word at address written as data
+// in a syntax.
+func disasmFormatData(address uint16, name string) string {
+	hi, lo := m.memory[address], m.memory[address+1]
+	switch name {
+	case "octo":
+		return fmt.Sprintf("0x%02X 0x%02X", hi, lo)
+	case "chipper":
+		return fmt.Sprintf("DB #%02X, #%02X", hi, lo)
+	}
+	return fmt.Sprintf("DB 0x%02x, 0x%02x", hi, lo)
+}
+
+// disasmHints returns the values of the registers used by the instruction
+// at address, with their notes.
+func disasmHints(address uint16) string {
+	syntax := disasmSyntaxes[disasm.syntax]
+	decoded := machineDisassembleInstruction(machineGetInstruction(address))
+	template := syntax.templates[decoded.op]
+
+	prefix := "V"
+	if disasm.syntax == "octo" {
+		prefix = "v"
+	}
+	hints := []string{}
+	register := func(x byte) {
+		hint := fmt.Sprintf("%s"+syntax.register+"=0x%02x", prefix, x, m.regs.v[x])
+		if note, ok := symbolsRegister(x); ok {
+			hint += " (" + note + ")"
+		}
+		hints = append(hints, hint)
+	}
+
+	usesX := strings.Contains(template, "$x")
+	usesY := strings.Contains(template, "$y")
+	switch decoded.op {
+	case shr, shl:
+		usesY = !m.quirks.shift
+	case jpv:
+		if m.quirks.jumping {
+			decoded.x = byte(decoded.nnn >> 8)
+		}
+		usesX = true
+	}
+	if usesX {
+		register(decoded.x)
+	}
+	if usesY {
+		register(decoded.y)
+	}
+	switch decoded.op {
+	case drw, addi, ldbcd, save, restore:
+		hints = append(hints, fmt.Sprintf("I=0x%03x", m.regs.i))
+	}
+	return strings.Join(hints, " ")
+}
+
+// disasmInstruction returns the instruction at address in the current
+// syntax.
+func disasmInstruction(address uint16) string {
+	return disasmFormat(address, disasm.syntax)
+}
+
+// disasmLine returns the address, the word and the instruction at address,
+// or its bytes if the coverage map shows they were only used as data, and
+// the register hints at PC.
+func disasmLine(address uint16) string {
+	text := disasmInstruction(address)
+	comments := []string{}
+	if kinds, ok := coverageData(address); ok {
+		text = disasmData(address)
+		comments = append(comments, kinds)
+	}
+	if disasm.hints && address == m.regs.pc {
+		if hints := disasmHints(address); hints != "" {
+			comments = append(comments, hints)
+		}
+	}
+
+	line := fmt.Sprintf("0x%03x: 0x%04x %s", address, machineGetInstruction(address), text)
+	if len(comments) > 0 {
+		line += " " + disasmSyntaxes[disasm.syntax].comment + " " + strings.Join(comments, " ")
+	}
+	return line
+}
+
+func disasmSet(name string, value string) error {
+	switch name {
+	case "syntax":
+		if _, ok := disasmSyntaxes[value]; !ok {
+			return fmt.Errorf("unknown syntax %s, known syntaxes are chipper, cowgod and octo", value)
+		}
+		disasm.syntax = value
+
+	case "symbols", "hints":
+		if value != "on" && value != "off" {
+			return errors.New("missing on or off")
+		}
+		if name == "symbols" {
+			disasm.symbols = value == "on"
+		} else {
+			disasm.hints = value == "on"
+		}
+
+	default:
+		return errors.New("unknown disassembler setting " + name)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+// Display settings
+//
+// The scale of the SDL window and its scaling filter, the colors of the
+// pixels and the fullscreen mode can be set from the command line, changed
+// with the display command and with hotkeys in the SDL window. The frontends
+// are told about changes through displayUpdate and apply them on their next
+// redraw.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	DISPLAYMAXSCALE = 32
+)
+
+type displaySettings struct {
+	scale      int    // size of a pixel in the window
+	scaling    string // filter used to scale the display
+	fullscreen bool
+}
+
+var display = displaySettings{scale: 8, scaling: "nearest"}
+
+// displayScalings maps the scaling filters to the values of the SDL render
+// scale quality hint.
+var displayScalings = map[string]string{
+	"nearest": "0",
+	"linear":  "1",
+	"best":    "2",
+}
+
+// displayUpdate asks the frontend to apply the settings and redraw.
+var displayUpdate = make(chan struct{}, 1)
+
+// displayPending tells that the settings changed since the frontend was
+// last notified.
+var displayPending bool
+
+// displayChanged notifies the frontend once the emulation goroutine has
+// published the settings in a snapshot.
+func displayChanged() {
+	displayPending = true
+}
+
+// displayNotify notifies the frontend of the settings changed, without
+// waiting for it.
+func displayNotify() {
+	if !displayPending {
+		return
+	}
+	displayPending = false
+	select {
+	case displayUpdate <- struct{}{}:
+	default:
+	}
+}
+
+func displayCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("scale      %d\n", display.scale)
+		fmt.Printf("scaling    %s\n", display.scaling)
+		fmt.Printf("foreground %s\n", paletteFormatColor(displayPalette.foreground))
+		fmt.Printf("background %s\n", paletteFormatColor(displayPalette.background))
+		fmt.Printf("fullscreen %t\n", display.fullscreen)
+		return nil
+	}
+	if len(args) < 2 && args[0] != "fullscreen" {
+		return fmt.Errorf("missing %s value", args[0])
+	}
+	value := ""
+	if len(args) > 1 {
+		value = args[1]
+	}
+	return displaySet(args[0], value)
+}
+
+// displaySet changes one setting: scale, scaling, palette, fg, bg or
+// fullscreen (on, off or an empty value to toggle it).
+func displaySet(name string, value string) error {
+	switch name {
+	case "scale":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > DISPLAYMAXSCALE {
+			return fmt.Errorf("invalid scale %s", value)
+		}
+		display.scale = n
+
+	case "scaling":
+		if _, ok := displayScalings[value]; !ok {
+			return fmt.Errorf("invalid scaling %s, expected nearest, linear or best", value)
+		}
+		display.scaling = value
+
+	case "palette":
+		p, err := paletteParse(value)
+		if err != nil {
+			return err
+		}
+		displayPalette = p
+
+	case "fg", "foreground":
+		c, err := paletteColor(value)
+		if err != nil {
+			return err
+		}
+		displayPalette.foreground = c
+
+	case "bg", "background":
+		c, err := paletteColor(value)
+		if err != nil {
+			return err
+		}
+		displayPalette.background = c
+
+	case "fullscreen":
+		switch value {
+		case "":
+			display.fullscreen = !display.fullscreen
+		case "on":
+			display.fullscreen = true
+		case "off":
+			display.fullscreen = false
+		default:
+			return fmt.Errorf("invalid fullscreen value %s", value)
+		}
+
+	default:
+		return errors.New("unknown display setting " + name)
+	}
+	displayChanged()
+	return nil
+}
+
+// displayNextPalette switches to the palette following the current one in
+// the sorted list of palettes.
+func displayNextPalette() {
+	names := paletteNames()
+	next := names[0]
+	for n, name := range names {
+		if palettes[name] == displayPalette && n+1 < len(names) {
+			next = names[n+1]
+		}
+	}
+	displaySet("palette", next)
+}
+
+// displayViewport returns the size of a pixel and the offsets of the display
+// in a window of the given size: the largest integer scale that fits, the
+// display being centered with borders of the background color.
+func displayViewport(width int, height int) (int, int, int) {
+	size := width / SCREENWIDTH
+	if height/SCREENHEIGHT < size {
+		size = height / SCREENHEIGHT
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size, (width - SCREENWIDTH*size) / 2, (height - SCREENHEIGHT*size) / 2
+}
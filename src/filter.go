@@ -0,0 +1,265 @@
+package main
+
+// Display filters
+//
+// CHIP-8 programs erase and draw their sprites again with XOR every frame,
+// so that moving sprites are unlit part of the time and flicker. Filters
+// run on the pixmap at every 60Hz frame and turn it into levels of
+// brightness, from 0 (background) to FILTERLEVELS-1 (foreground):
+//
+//   - blend averages the last frames,
+//   - decay dims unlit pixels progressively as the phosphor of a CRT,
+//   - hold keeps a pixel lit for one more frame after it was erased.
+//
+// Hold can be combined with blend or decay. The frontends, screenshots and
+// recordings all show the filtered display.
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+const (
+	FILTERLEVELS    = 16
+	FILTERMAXFRAMES = 16
+)
+
+type filterLevels [SCREENWIDTH][SCREENHEIGHT]uint8
+
+type filterSettings struct {
+	kind   string  // none, blend or decay
+	frames int     // frames blended
+	decay  float64 // brightness kept by an unlit pixel every frame
+	hold   bool
+}
+
+var filterDefaults = filterSettings{kind: "none", frames: 3, decay: 0.5}
+
+var filter = filterDefaults
+
+// filterState is the output of the filters and the frames they remember.
+var filterState struct {
+	output    filterLevels
+	changed   bool
+	previous  [SCREENWIDTH][SCREENHEIGHT]uint8 // pixmap of the previous frame
+	history   [][SCREENWIDTH][SCREENHEIGHT]float64
+	intensity [SCREENWIDTH][SCREENHEIGHT]float64
+}
+
+// filterActive tells if the display is filtered.
+func filterActive() bool {
+	return filter.kind != "none" || filter.hold
+}
+
+// filterApply applies a filter command to settings.
+func filterApply(f *filterSettings, args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing filter")
+	}
+	switch args[0] {
+	case "none":
+		f.kind = "none"
+		f.hold = false
+
+	case "blend":
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 2 || n > FILTERMAXFRAMES {
+				return fmt.Errorf("invalid number of frames %s", args[1])
+			}
+			f.frames = n
+		}
+		f.kind = "blend"
+
+	case "decay":
+		if len(args) > 1 {
+			decay, err := strconv.ParseFloat(args[1], 64)
+			if err != nil || decay <= 0 || decay >= 1 {
+				return fmt.Errorf("invalid decay %s, expected a factor between 0 and 1", args[1])
+			}
+			f.decay = decay
+		}
+		f.kind = "decay"
+
+	case "hold":
+		if len(args) < 2 {
+			return errors.New("missing on or off")
+		}
+		switch args[1] {
+		case "on":
+			f.hold = true
+		case "off":
+			f.hold = false
+		default:
+			return fmt.Errorf("invalid hold value %s", args[1])
+		}
+
+	default:
+		return fmt.Errorf("invalid filter %s", args[0])
+	}
+	return nil
+}
+
+// filterColor returns the color of a level of brightness.
+func filterColor(level uint8, p palette) color.RGBA {
+	mix := func(background uint8, foreground uint8) uint8 {
+		return uint8((int(background)*(FILTERLEVELS-1-int(level)) + int(foreground)*int(level)) / (FILTERLEVELS - 1))
+	}
+	return color.RGBA{
+		mix(p.background.R, p.foreground.R),
+		mix(p.background.G, p.foreground.G),
+		mix(p.background.B, p.foreground.B),
+		0xff,
+	}
+}
+
+func filterCommand(args []string) error {
+	if len(args) == 0 {
+		switch filter.kind {
+		case "blend":
+			fmt.Printf("blend %d frames", filter.frames)
+		case "decay":
+			fmt.Printf("decay %g", filter.decay)
+		default:
+			fmt.Print("none")
+		}
+		fmt.Printf(", hold %t\n", filter.hold)
+		return nil
+	}
+	if err := filterApply(&filter, args); err != nil {
+		return err
+	}
+	filterReset()
+	displayChanged()
+	return nil
+}
+
+// filterFrameTick is called by the machine for every 60Hz frame.
+func filterFrameTick() {
+	s := &filterState
+	if !filterActive() {
+		return
+	}
+
+	var frame [SCREENWIDTH][SCREENHEIGHT]float64
+	for x := 0; x < SCREENWIDTH; x++ {
+		for y := 0; y < SCREENHEIGHT; y++ {
+			if m.pixmap[x][y] != 0 || (filter.hold && s.previous[x][y] != 0) {
+				frame[x][y] = 1
+			}
+		}
+	}
+	s.previous = m.pixmap
+
+	switch filter.kind {
+	case "blend":
+		s.history = append(s.history, frame)
+		if len(s.history) > filter.frames {
+			s.history = s.history[1:]
+		}
+		for x := 0; x < SCREENWIDTH; x++ {
+			for y := 0; y < SCREENHEIGHT; y++ {
+				sum := 0.0
+				for _, f := range s.history {
+					sum += f[x][y]
+				}
+				frame[x][y] = sum / float64(len(s.history))
+			}
+		}
+
+	case "decay":
+		for x := 0; x < SCREENWIDTH; x++ {
+			for y := 0; y < SCREENHEIGHT; y++ {
+				if decayed := s.intensity[x][y] * filter.decay; decayed > frame[x][y] {
+					frame[x][y] = decayed
+				}
+			}
+		}
+		s.intensity = frame
+	}
+
+	var output filterLevels
+	for x := 0; x < SCREENWIDTH; x++ {
+		for y := 0; y < SCREENHEIGHT; y++ {
+			output[x][y] = uint8(frame[x][y]*(FILTERLEVELS-1) + 0.5)
+		}
+	}
+	if output != s.output {
+		s.output = output
+		s.changed = true
+	}
+}
+
+// filterOutput returns the display to show: the output of the filters, or
+// the pixmap if there is no filter.
+func filterOutput() filterLevels {
+	if filterActive() {
+		return filterState.output
+	}
+	return filterPixmap()
+}
+
+// filterParse returns the settings given by filter commands separated by
+// commas, such as "decay 0.5,hold on", applied to the default settings.
+func filterParse(value string) (filterSettings, error) {
+	f := filterDefaults
+	for _, command := range strings.Split(value, ",") {
+		if err := filterApply(&f, strings.Fields(command)); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// filterPixmap returns the levels of the unfiltered pixmap.
+func filterPixmap() filterLevels {
+	var output filterLevels
+	for x := 0; x < SCREENWIDTH; x++ {
+		for y := 0; y < SCREENHEIGHT; y++ {
+			output[x][y] = m.pixmap[x][y] * (FILTERLEVELS - 1)
+		}
+	}
+	return output
+}
+
+// filterReset forgets the frames remembered by the filters.
+func filterReset() {
+	filterState.history = nil
+	filterState.intensity = [SCREENWIDTH][SCREENHEIGHT]float64{}
+	filterState.previous = m.pixmap
+	filterState.output = filterPixmap()
+	filterState.changed = true
+}
+
+// filterString returns filter settings as the filter commands understood by
+// filterParse.
+func filterString(f filterSettings) string {
+	var s string
+	switch f.kind {
+	case "blend":
+		s = fmt.Sprintf("blend %d", f.frames)
+	case "decay":
+		s = fmt.Sprintf("decay %g", f.decay)
+	default:
+		s = "none"
+	}
+	if f.hold {
+		s += ",hold on"
+	}
+	return s
+}
+
+// filterTakeDirty tells if the display changed since the last call, the
+// filtered display changing for a while after the pixmap did.
+func filterTakeDirty() bool {
+	dirty := machineTakeDirty()
+	if !filterActive() {
+		return dirty
+	}
+	changed := filterState.changed
+	filterState.changed = false
+	return changed
+}
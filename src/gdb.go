@@ -0,0 +1,398 @@
+package main
+
+// GDB remote serial protocol stub, see
+// https://sourceware.org/gdb/current/onlinedocs/gdb/Remote-Protocol.html
+//
+// Registers are numbered V0 to VF (0 to 15), then I (16), PC (17), SP (18),
+// DT (19) and ST (20). 16-bit registers are sent big-endian, like CHIP-8
+// instructions.
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	GDBREGISTERS = 21
+	GDBSIGINT    = "S02"
+	GDBSIGTRAP   = "S05"
+)
+
+// gdbSession holds the state of a connection with a GDB client. Packets are
+// read by a separate goroutine so that a ^C from the client can interrupt a
+// running machine. They are handled on the emulation goroutine, but for the
+// wait for a continued machine to stop.
+type gdbSession struct {
+	conn       net.Conn
+	packets    chan string
+	interrupts chan struct{}
+	quit       chan struct{}
+	stopped    <-chan bool // outcome of the run started by a continue packet
+}
+
+func gdbChecksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// gdbContinue waits for the machine started by a continue packet to stop
+// and returns the stop reply.
+func gdbContinue(s *gdbSession) string {
+	defer func() { s.stopped = nil }()
+
+	for {
+		select {
+		case hit := <-s.stopped:
+			if hit {
+				return GDBSIGTRAP
+			}
+			return GDBSIGINT
+
+		case <-s.interrupts:
+			machineDo(machineStop)
+
+		case packet, ok := <-s.packets:
+			// gdb is not supposed to send anything but ^C while the
+			// target runs, stop the machine if the client went away
+			if !ok {
+				machineDo(machineStop)
+				<-s.stopped
+				return ""
+			}
+			fmt.Printf("gdb: ignoring packet %s while running\n", packet)
+		}
+	}
+}
+
+// gdbHandle processes a packet on the emulation goroutine and returns the
+// reply. It returns false when the session is over. For continue packets,
+// the machine is started and the reply is left to gdbContinue.
+func gdbHandle(s *gdbSession, packet string) (string, bool) {
+	if packet == "" {
+		return "", true
+	}
+
+	switch packet[0] {
+	case '?':
+		return GDBSIGTRAP, true
+
+	case 'c':
+		if len(packet) > 1 {
+			address, err := strconv.ParseUint(packet[1:], 16, 16)
+			if err != nil || machineSetRegister("pc", uint16(address)) != nil {
+				return "E01", true
+			}
+		}
+		s.stopped = machineRun()
+		return "", true
+
+	case 'D':
+		return "OK", false
+
+	case 'g':
+		var regs strings.Builder
+		for n := 0; n < GDBREGISTERS; n++ {
+			regs.WriteString(gdbReadRegister(n))
+		}
+		return regs.String(), true
+
+	case 'G':
+		// the registers are left unchanged if one of them is invalid
+		data, regs := packet[1:], m.regs
+		for n := 0; n < GDBREGISTERS; n++ {
+			size := len(gdbReadRegister(n))
+			if len(data) < size || !gdbWriteRegister(n, data[:size]) {
+				m.regs = regs
+				return "E01", true
+			}
+			data = data[size:]
+		}
+		return "OK", true
+
+	case 'H':
+		return "OK", true
+
+	case 'k':
+		return "", false
+
+	case 'm':
+		address, length, ok := gdbParseRange(packet[1:])
+		if !ok {
+			return "E01", true
+		}
+		return hex.EncodeToString(m.memory[address : address+length]), true
+
+	case 'M':
+		parts := strings.SplitN(packet[1:], ":", 2)
+		if len(parts) != 2 {
+			return "E01", true
+		}
+		address, length, ok := gdbParseRange(parts[0])
+		data, err := hex.DecodeString(parts[1])
+		if !ok || err != nil || len(data) != length {
+			return "E01", true
+		}
+		copy(m.memory[address:], data)
+		return "OK", true
+
+	case 'p':
+		n, err := strconv.ParseUint(packet[1:], 16, 8)
+		if err != nil || n >= GDBREGISTERS {
+			return "E01", true
+		}
+		return gdbReadRegister(int(n)), true
+
+	case 'P':
+		parts := strings.SplitN(packet[1:], "=", 2)
+		if len(parts) != 2 {
+			return "E01", true
+		}
+		n, err := strconv.ParseUint(parts[0], 16, 8)
+		if err != nil || n >= GDBREGISTERS || !gdbWriteRegister(int(n), parts[1]) {
+			return "E01", true
+		}
+		return "OK", true
+
+	case 'q':
+		return gdbQuery(packet), true
+
+	case 's':
+		if len(packet) > 1 {
+			address, err := strconv.ParseUint(packet[1:], 16, 16)
+			if err != nil || machineSetRegister("pc", uint16(address)) != nil {
+				return "E01", true
+			}
+		}
+		machineStep()
+		return GDBSIGTRAP, true
+
+	case 'Z', 'z':
+		// Software (Z0) and hardware (Z1) breakpoints are both mapped to
+		// the machine breakpoints, watchpoints are not supported
+		parts := strings.Split(packet[1:], ",")
+		if len(parts) < 2 || (parts[0] != "0" && parts[0] != "1") {
+			return "", true
+		}
+		// instructions are at even addresses and must fit in memory
+		address, err := strconv.ParseUint(parts[1], 16, 16)
+		if err != nil || address > MEMEND-2 || address%2 != 0 {
+			return "E01", true
+		}
+		if packet[0] == 'Z' {
+			machineAddBreakpoint(uint16(address))
+		} else {
+			machineDeleteBreakpointAt(uint16(address))
+		}
+		return "OK", true
+	}
+
+	// Empty reply for unsupported packets
+	return "", true
+}
+
+// gdbParseRange parses the "addr,length" argument of memory packets.
+func gdbParseRange(arg string) (int, int, bool) {
+	parts := strings.SplitN(arg, ",", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	address, err := strconv.ParseUint(parts[0], 16, 16)
+	if err != nil {
+		return 0, 0, false
+	}
+	length, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil || address+length > MEMEND {
+		return 0, 0, false
+	}
+	return int(address), int(length), true
+}
+
+func gdbQuery(packet string) string {
+	switch {
+	case strings.HasPrefix(packet, "qSupported"):
+		return "PacketSize=4000;qXfer:features:read+"
+
+	case packet == "qAttached":
+		return "1"
+
+	case packet == "qC":
+		return "QC1"
+
+	case packet == "qfThreadInfo":
+		return "m1"
+
+	case packet == "qsThreadInfo":
+		return "l"
+
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		offset, length, ok := gdbParseRange(strings.TrimPrefix(packet, "qXfer:features:read:target.xml:"))
+		xml := gdbTargetDescription()
+		if !ok {
+			return "E01"
+		}
+		if offset >= len(xml) {
+			return "l"
+		}
+		if offset+length >= len(xml) {
+			return "l" + xml[offset:]
+		}
+		return "m" + xml[offset:offset+length]
+	}
+	return ""
+}
+
+// gdbReadPackets runs in its own goroutine, acknowledges the packets sent by
+// the client and queues them. The packets channel is closed when the
+// connection is lost.
+func gdbReadPackets(s *gdbSession) {
+	defer close(s.packets)
+
+	reader := bufio.NewReader(s.conn)
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+
+		switch c {
+		case 0x03:
+			select {
+			case s.interrupts <- struct{}{}:
+			default:
+			}
+
+		case '$':
+			data, err := reader.ReadString('#')
+			if err != nil {
+				return
+			}
+			data = strings.TrimSuffix(data, "#")
+
+			checksum := make([]byte, 2)
+			if _, err := io.ReadFull(reader, checksum); err != nil {
+				return
+			}
+			sum, err := strconv.ParseUint(string(checksum), 16, 8)
+			if err != nil || byte(sum) != gdbChecksum(data) {
+				s.conn.Write([]byte("-"))
+				continue
+			}
+			s.conn.Write([]byte("+"))
+			select {
+			case s.packets <- data:
+			case <-s.quit:
+				return
+			}
+		}
+		// acknowledgments from the client ('+' and '-') are ignored
+	}
+}
+
+func gdbReadRegister(n int) string {
+	switch {
+	case n < 16:
+		return fmt.Sprintf("%02x", m.regs.v[n])
+	case n == 16:
+		return fmt.Sprintf("%04x", m.regs.i)
+	case n == 17:
+		return fmt.Sprintf("%04x", m.regs.pc)
+	case n == 18:
+		return fmt.Sprintf("%02x", m.regs.sp)
+	case n == 19:
+		return fmt.Sprintf("%02x", m.regs.dt)
+	default:
+		return fmt.Sprintf("%02x", m.regs.st)
+	}
+}
+
+// gdbServe listens for GDB clients on address and serves them one at a
+// time. It only returns if it cannot listen.
+func gdbServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	fmt.Printf("Waiting for gdb on %s\n", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("gdb connected from %s\n", conn.RemoteAddr())
+		gdbSessionRun(&gdbSession{
+			conn:       conn,
+			packets:    make(chan string),
+			interrupts: make(chan struct{}, 1),
+			quit:       make(chan struct{}),
+		})
+		fmt.Printf("gdb disconnected\n")
+	}
+}
+
+func gdbSessionRun(s *gdbSession) {
+	defer s.conn.Close()
+	defer close(s.quit)
+	go gdbReadPackets(s)
+
+	for packet := range s.packets {
+		var reply string
+		var more bool
+		machineDo(func() {
+			reply, more = gdbHandle(s, packet)
+		})
+		if s.stopped != nil {
+			reply = gdbContinue(s)
+		}
+		if packet != "k" {
+			fmt.Fprintf(s.conn, "$%s#%02x", reply, gdbChecksum(reply))
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+func gdbTargetDescription() string {
+	var xml strings.Builder
+	xml.WriteString(`<?xml version="1.0"?><!DOCTYPE target SYSTEM "gdb-target.dtd"><target version="1.0"><feature name="org.chip8.cpu">`)
+	for n := 0; n < 16; n++ {
+		fmt.Fprintf(&xml, `<reg name="v%x" bitsize="8" type="uint8"/>`, n)
+	}
+	xml.WriteString(`<reg name="i" bitsize="16" type="data_ptr"/>`)
+	xml.WriteString(`<reg name="pc" bitsize="16" type="code_ptr"/>`)
+	xml.WriteString(`<reg name="sp" bitsize="8" type="uint8"/>`)
+	xml.WriteString(`<reg name="dt" bitsize="8" type="uint8"/>`)
+	xml.WriteString(`<reg name="st" bitsize="8" type="uint8"/>`)
+	xml.WriteString(`</feature></target>`)
+	return xml.String()
+}
+
+func gdbWriteRegister(n int, value string) bool {
+	bits := 8
+	if n == 16 || n == 17 {
+		bits = 16
+	}
+	if n >= GDBREGISTERS || len(value) != bits/4 {
+		return false
+	}
+	v, err := strconv.ParseUint(value, 16, bits)
+	if err != nil {
+		return false
+	}
+
+	name := fmt.Sprintf("v%x", n)
+	if n >= 16 {
+		name = []string{"i", "pc", "sp", "dt", "st"}[n-16]
+	}
+	return machineSetRegister(name, uint16(v)) == nil
+}
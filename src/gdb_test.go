@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gdbTestClient talks to a gdb session served on a TCP socket.
+type gdbTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// gdbTestStart loads program, starts the emulation goroutine and serves a
+// gdb session on a local socket.
+func gdbTestStart(t *testing.T, program []byte) *gdbTestClient {
+	m = machine{}
+	machineInitialize()
+	copy(m.memory[MEMPROGRAMSTART:], program)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		machineLoop(ctx, make(chan struct{}, 1), make(chan struct{}, 1))
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		machineClearBreakpoints()
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		gdbSessionRun(&gdbSession{
+			conn:       conn,
+			packets:    make(chan string),
+			interrupts: make(chan struct{}, 1),
+			quit:       make(chan struct{}),
+		})
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &gdbTestClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// ack reads the acknowledgment of a packet.
+func (c *gdbTestClient) ack() byte {
+	b, err := c.reader.ReadByte()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return b
+}
+
+// reply reads a packet, checks its framing and checksum and acknowledges it.
+func (c *gdbTestClient) reply() string {
+	if b, err := c.reader.ReadByte(); err != nil || b != '$' {
+		c.t.Fatalf("got %q, %v, expected the start of a packet", b, err)
+	}
+	data, err := c.reader.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	data = strings.TrimSuffix(data, "#")
+	checksum := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, checksum); err != nil {
+		c.t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("%02x", gdbChecksum(data)); string(checksum) != expected {
+		c.t.Fatalf("packet %q: got checksum %s, expected %s", data, checksum, expected)
+	}
+	c.conn.Write([]byte("+"))
+	return data
+}
+
+func (c *gdbTestClient) send(packet string) {
+	fmt.Fprintf(c.conn, "$%s#%02x", packet, gdbChecksum(packet))
+	if b := c.ack(); b != '+' {
+		c.t.Fatalf("packet %q: got acknowledgment %q", packet, b)
+	}
+}
+
+// exchange sends a packet and checks the reply.
+func (c *gdbTestClient) exchange(packet string, expected string) {
+	c.t.Helper()
+	c.send(packet)
+	if reply := c.reply(); reply != expected {
+		c.t.Errorf("packet %q: got reply %q, expected %q", packet, reply, expected)
+	}
+}
+
+func TestGdbFraming(t *testing.T) {
+	c := gdbTestStart(t, nil)
+
+	if gdbChecksum("OK") != 0x9a {
+		t.Errorf("got checksum %02x for OK, expected 9a", gdbChecksum("OK"))
+	}
+	// packets with a bad checksum are rejected and not handled
+	c.conn.Write([]byte("$?#00"))
+	if b := c.ack(); b != '-' {
+		t.Errorf("got acknowledgment %q for a bad checksum, expected -", b)
+	}
+	c.conn.Write([]byte("$?#zz"))
+	if b := c.ack(); b != '-' {
+		t.Errorf("got acknowledgment %q for an invalid checksum, expected -", b)
+	}
+	// acknowledgments from the client are ignored
+	c.conn.Write([]byte("++"))
+	c.exchange("?", GDBSIGTRAP)
+	c.exchange("qC", "QC1")
+	c.exchange("vMustReplyEmpty", "")
+	c.exchange("D", "OK")
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		t.Errorf("got %v after detaching, expected the connection to be closed", err)
+	}
+}
+
+func TestGdbRegisters(t *testing.T) {
+	c := gdbTestStart(t, []byte{0x60, 0x05, 0x70, 0x01, 0x12, 0x02})
+	zeros := strings.Repeat("00", 16)
+
+	c.exchange("g", zeros+"0000"+"0200"+"10"+"00"+"00")
+	c.exchange("p11", "0200")
+	c.exchange("p15", "E01")
+
+	c.exchange("P0=2a", "OK")
+	c.exchange("P10=0300", "OK")
+	c.exchange("p0", "2a")
+	c.exchange("p10", "0300")
+	c.exchange("P11=0ffe", "OK")
+	c.exchange("P11=0fff", "E01")
+	c.exchange("P11=ffff", "E01")
+	c.exchange("P12=11", "E01")
+	c.exchange("P0=2", "E01")
+	c.exchange("P15=00", "E01")
+	c.exchange("p11", "0ffe")
+
+	regs := "01" + strings.Repeat("00", 15) + "0123" + "0202" + "0f" + "03" + "04"
+	c.exchange("G"+regs, "OK")
+	c.exchange("g", regs)
+	// the registers are left unchanged if one of them is invalid
+	c.exchange("G"+zeros+"0000"+"1000"+"10"+"00"+"00", "E01")
+	c.exchange("G"+zeros, "E01")
+	c.exchange("g", regs)
+}
+
+func TestGdbMemory(t *testing.T) {
+	c := gdbTestStart(t, []byte{0x60, 0x05, 0x70, 0x01, 0x12, 0x02})
+
+	c.exchange("m200,6", "600570011202")
+	c.exchange("m0,5", "f0909090f0")
+	c.exchange("mffe,2", "0000")
+	c.exchange("mfff,2", "E01")
+	c.exchange("m200", "E01")
+
+	c.exchange("M300,2:abcd", "OK")
+	c.exchange("m300,2", "abcd")
+	c.exchange("M300,2:ab", "E01")
+	c.exchange("M300,2:zzzz", "E01")
+	c.exchange("Mfff,2:abcd", "E01")
+	c.exchange("M300:abcd", "E01")
+	c.exchange("m300,2", "abcd")
+}
+
+func TestGdbExecution(t *testing.T) {
+	c := gdbTestStart(t, []byte{0x60, 0x05, 0x70, 0x01, 0x12, 0x02})
+
+	c.exchange("?", GDBSIGTRAP)
+	c.exchange("s", GDBSIGTRAP)
+	c.exchange("p0", "05")
+	c.exchange("p11", "0202")
+	c.exchange("s0200", GDBSIGTRAP)
+	c.exchange("p11", "0202")
+	c.exchange("sffff", "E01")
+	c.exchange("s0fff", "E01")
+	c.exchange("c0fff", "E01")
+
+	c.exchange("Z0,204,2", "OK")
+	c.exchange("Z1,204,2", "OK")
+	c.exchange("Z0,201,2", "E01")
+	c.exchange("Z0,fff,2", "E01")
+	c.exchange("Z0,1000,2", "E01")
+	c.exchange("Z2,204,2", "")
+	c.exchange("c", GDBSIGTRAP)
+	c.exchange("p11", "0204")
+	c.exchange("p0", "06")
+	// a breakpoint at the address the machine continues from is skipped
+	c.exchange("c", GDBSIGTRAP)
+	c.exchange("p11", "0204")
+	c.exchange("p0", "07")
+
+	c.exchange("z0,204,2", "OK")
+	c.exchange("z1,204,2", "OK")
+	c.exchange("z0,201,2", "E01")
+	c.send("c")
+	c.conn.Write([]byte{0x03})
+	if reply := c.reply(); reply != GDBSIGINT {
+		t.Errorf("got reply %q to an interrupt, expected %q", reply, GDBSIGINT)
+	}
+	// kill packets get no reply and end the session
+	c.send("k")
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		t.Errorf("got %v after killing, expected the connection to be closed", err)
+	}
+}
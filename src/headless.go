@@ -0,0 +1,22 @@
+package main
+
+// Headless frontend
+//
+// Without any frontend, nothing is displayed nor played: the machine ticks
+// are simply consumed. This is meant for scripts, for instance running in CI
+// where there is no display, screenshots and recordings working as usual.
+
+import (
+	"context"
+)
+
+func headlessRun(ctx context.Context, buzz chan struct{}, draw chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-buzz:
+		case <-draw:
+		}
+	}
+}
@@ -1,127 +1,212 @@
 package main
 
-// typedef unsigned char Uint8;
-// void SineWave(void *userdata, Uint8 *stream, int len);
-import "C"
 import (
+	"context"
 	"github.com/veandco/go-sdl2/sdl"
 	"log"
-	"math"
-	"reflect"
-	"unsafe"
-)
-
-const (
-	MAGNIFICATION = 8
-	SAMPLEHZ      = 48000
-	TONEHZ        = 440
-	DPHASE        = 2 * math.Pi * TONEHZ / SAMPLEHZ
+	"strconv"
 )
 
 var window *sdl.Window
-var surface, pixelSurface *sdl.Surface
-var pixelRect *sdl.Rect
-var black, white uint32
-var sample_nr int
-
-//export SineWave
-func SineWave(userdata unsafe.Pointer, stream *C.Uint8, length C.int) {
-	n := int(length)
-	hdr := reflect.SliceHeader{Data: uintptr(unsafe.Pointer(stream)), Len: n, Cap: n}
-	buf := *(*[]C.Uint8)(unsafe.Pointer(&hdr))
-
-	var phase float64
-	for i := 0; i < n; i += 2 {
-		phase += DPHASE
-		sample := C.Uint8((math.Sin(phase) + 0.999999) * 128)
-		buf[i] = sample
-		buf[i+1] = sample
-	}
-}
+var renderer *sdl.Renderer
+
+// The display, filtered, is copied to a streaming texture of SCREENWIDTH x
+// SCREENHEIGHT RGBA pixels which the renderer scales to the window. The
+// texture is created again when the scaling filter changes.
+var texture *sdl.Texture
+var textureScaling string
+
+// ioResized tells the display goroutine that the window size changed.
+var ioResized = make(chan struct{}, 1)
 
 func ioCleanupDisplay() {
+	texture.Destroy()
+	renderer.Destroy()
 	window.Destroy()
-	sdl.CloseAudio()
+	audioClose()
 	sdl.Quit()
 }
 
-func ioInit() {
+// ioInit opens the window and the audio device. With vsync, presenting a
+// frame waits for the vertical blank of the monitor.
+func ioInit(vsync bool) error {
 	// TODO: assign err and process it
 	sdl.Init(sdl.INIT_EVERYTHING)
 
-	window, _ = sdl.CreateWindow("CHIP-8", sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED, SCREENWIDTH*MAGNIFICATION, SCREENHEIGHT*MAGNIFICATION, sdl.WINDOW_SHOWN)
-	surface, _ = window.GetSurface()
-
-	black = sdl.MapRGB(surface.Format, 0x00, 0x00, 0x00)
-	white = sdl.MapRGB(surface.Format, 0xff, 0xff, 0xff)
+	var err error
+	window, err = sdl.CreateWindow("CHIP-8", sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED, int32(SCREENWIDTH*display.scale), int32(SCREENHEIGHT*display.scale), sdl.WINDOW_SHOWN|sdl.WINDOW_RESIZABLE)
+	if err != nil {
+		return err
+	}
+	flags := uint32(sdl.RENDERER_ACCELERATED)
+	if vsync {
+		flags |= sdl.RENDERER_PRESENTVSYNC
+	}
+	if renderer, err = sdl.CreateRenderer(window, -1, flags); err != nil {
+		// fall back to any renderer, software included
+		if renderer, err = sdl.CreateRenderer(window, -1, 0); err != nil {
+			return err
+		}
+	}
+	if err := ioApplySettings(display); err != nil {
+		return err
+	}
 
-	pixelSurface, _ = sdl.CreateRGBSurface(0, MAGNIFICATION, MAGNIFICATION, 8, 0, 0, 0, 0)
-	pixelSurface.FillRect(nil, white)
+	// the machine can run without sound
+	if err := audioOpen(); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
 
-	pixelRect = new(sdl.Rect)
-	pixelRect.W = MAGNIFICATION
-	pixelRect.H = MAGNIFICATION
+// ioApplySettings resizes the window to the display scale, switches
+// fullscreen mode on or off and creates the texture if the scaling filter
+// changed.
+func ioApplySettings(settings displaySettings) error {
+	if settings.fullscreen {
+		window.SetFullscreen(sdl.WINDOW_FULLSCREEN_DESKTOP)
+	} else {
+		window.SetFullscreen(0)
+		window.SetSize(int32(SCREENWIDTH*settings.scale), int32(SCREENHEIGHT*settings.scale))
+	}
 
-	spec := &sdl.AudioSpec{
-		Freq:     SAMPLEHZ,
-		Format:   sdl.AUDIO_U8,
-		Channels: 2,
-		Samples:  SAMPLEHZ,
-		Callback: sdl.AudioCallback(C.SineWave),
+	if texture != nil && textureScaling == settings.scaling {
+		return nil
+	}
+	if texture != nil {
+		texture.Destroy()
+	}
+	// the hint applies to the textures created afterwards
+	sdl.SetHint(sdl.HINT_RENDER_SCALE_QUALITY, displayScalings[settings.scaling])
+	var err error
+	texture, err = renderer.CreateTexture(sdl.PIXELFORMAT_RGBA32, sdl.TEXTUREACCESS_STREAMING, SCREENWIDTH, SCREENHEIGHT)
+	if err != nil {
+		return err
 	}
+	textureScaling = settings.scaling
+	return nil
+}
 
-	if err := sdl.OpenAudio(spec, nil); err != nil {
+func ioRedrawDisplay(snapshot *machineSnapshot) {
+	pixels, pitch, err := texture.Lock(nil)
+	if err != nil {
 		log.Println(err)
 		return
 	}
-}
-
-func ioRedrawDisplay() {
-	surface.FillRect(nil, black)
-
-	for x := 0; x < SCREENWIDTH; x++ {
-		for y := 0; y < SCREENHEIGHT; y++ {
-			if m.pixmap[x][y] == 1 {
-				pixelRect.X = int32(x * MAGNIFICATION)
-				pixelRect.Y = int32(y * MAGNIFICATION)
-				pixelSurface.Blit(nil, surface, pixelRect)
-			}
+	for y := 0; y < SCREENHEIGHT; y++ {
+		row := pixels[y*pitch:]
+		for x := 0; x < SCREENWIDTH; x++ {
+			c := filterColor(snapshot.display[x][y], snapshot.palette)
+			p := row[x*4 : x*4+4]
+			p[0], p[1], p[2], p[3] = c.R, c.G, c.B, 0xff
 		}
 	}
-	window.UpdateSurface()
+	texture.Unlock()
+
+	// the borders around the display have the background color
+	bg := snapshot.palette.background
+	renderer.SetDrawColor(bg.R, bg.G, bg.B, 0xff)
+	renderer.Clear()
+	width, height, err := renderer.GetOutputSize()
+	if err != nil {
+		return
+	}
+	size, left, top := displayViewport(int(width), int(height))
+	renderer.Copy(texture, nil, &sdl.Rect{X: int32(left), Y: int32(top), W: int32(SCREENWIDTH * size), H: int32(SCREENHEIGHT * size)})
+	renderer.Present()
 }
 
-func ioRunBuzzer(buzz chan struct{}) {
-	for {
-		<-buzz
-		//fmt.Printf("buzzer is alive: %d %t\n", m.regs.st, m.running)
-		if machinePlaySound() && machineIsRunning() {
-			sdl.PauseAudio(false)
-		} else {
-			sdl.PauseAudio(true)
+// ioHotkey changes the display settings: F7 and F8 decrease and increase
+// the scale, F9 switches to the next palette and F11 toggles fullscreen. It
+// returns false if the key is not a hotkey. It runs on the emulation
+// goroutine which owns the settings.
+func ioHotkey(key sdl.Keycode) bool {
+	switch key {
+	case sdl.K_F7:
+		if display.scale > 1 {
+			displaySet("scale", strconv.Itoa(display.scale-1))
+		}
+	case sdl.K_F8:
+		if display.scale < DISPLAYMAXSCALE {
+			displaySet("scale", strconv.Itoa(display.scale+1))
 		}
+	case sdl.K_F9:
+		displayNextPalette()
+	case sdl.K_F11:
+		displaySet("fullscreen", "")
+	default:
+		return false
 	}
+	return true
 }
 
-func ioRunDisplay(draw chan struct{}) {
+// ioRunDisplay redraws the window. The buzz ticks are only consumed, the
+// machine driving the beeper itself (see audio.go).
+func ioRunDisplay(ctx context.Context, buzz chan struct{}, draw chan struct{}) {
 	defer ioCleanupDisplay()
 
-	ioRedrawDisplay()
+	snapshot := machineSnapshotLatest()
+	ioRedrawDisplay(snapshot)
 	for {
-		<-draw
-		ioRedrawDisplay()
+		select {
+		case <-ctx.Done():
+			return
+		case <-buzz:
+			continue
+		case <-draw:
+			// nothing to do unless CLS or DRW changed the pixmap, or
+			// the filters changed the display
+			latest := machineSnapshotLatest()
+			if latest.version == snapshot.version {
+				continue
+			}
+			snapshot = latest
+		case <-displayUpdate:
+			snapshot = machineSnapshotLatest()
+			if err := ioApplySettings(snapshot.settings); err != nil {
+				log.Println(err)
+			}
+		case <-ioResized:
+		}
+		ioRedrawDisplay(snapshot)
 	}
 }
 
-func ioRunKeyboard() {
+// ioRunKeyboard handles the events of the window, keyboard and game
+// controllers, until ctx is cancelled.
+func ioRunKeyboard(ctx context.Context) {
 	var e sdl.Event
-	var k byte
 
-	for {
-		e = sdl.WaitEvent()
+	// controllers plugged in later are opened when they are added
+	for i := 0; i < sdl.NumJoysticks(); i++ {
+		if sdl.IsGameController(i) {
+			sdl.GameControllerOpen(i)
+		}
+	}
+
+	for ctx.Err() == nil {
+		// wake up regularly to notice the cancellation
+		e = sdl.WaitEventTimeout(100)
 		if e != nil {
 
 			switch e.(type) {
+			case *sdl.WindowEvent:
+				if e.(*sdl.WindowEvent).Event == sdl.WINDOWEVENT_SIZE_CHANGED {
+					select {
+					case ioResized <- struct{}{}:
+					default:
+					}
+				}
+
+			case *sdl.ControllerDeviceEvent:
+				if e.(*sdl.ControllerDeviceEvent).Type == sdl.CONTROLLERDEVICEADDED {
+					sdl.GameControllerOpen(int(e.(*sdl.ControllerDeviceEvent).Which))
+				}
+
+			case *sdl.ControllerButtonEvent:
+				button := sdl.GameControllerGetStringForButton(sdl.GameControllerButton(e.(*sdl.ControllerButtonEvent).Button))
+				machineSendKey(button, true, e.(*sdl.ControllerButtonEvent).State == sdl.PRESSED)
+
 			case *sdl.KeyboardEvent:
 
 				// We are not interested in repeat events
@@ -129,46 +214,22 @@ func ioRunKeyboard() {
 					continue
 				}
 
-				switch e.(*sdl.KeyboardEvent).Keysym.Sym {
-				case sdl.K_1:
-					k = 1 // 1 maps to 1
-				case sdl.K_2:
-					k = 2 // 2 maps to 2
-				case sdl.K_3:
-					k = 3 // 3 maps to 3
-				case sdl.K_4:
-					k = 12 // 4 maps to C
-				case sdl.K_q:
-					k = 4 // q maps to 4
-				case sdl.K_w:
-					k = 5 // w maps to 5
-				case sdl.K_e:
-					k = 6 // e maps to 6
-				case sdl.K_r:
-					k = 13 // r maps to D
-				case sdl.K_a:
-					k = 7 // a maps to 7
-				case sdl.K_s:
-					k = 8 // s maps to 8
-				case sdl.K_d:
-					k = 9 // d maps to 9
-				case sdl.K_f:
-					k = 14 // f maps to E
-				case sdl.K_z:
-					k = 10 // z maps to A
-				case sdl.K_x:
-					k = 0 // x maps to 0
-				case sdl.K_c:
-					k = 11 // c maps to B
-				case sdl.K_v:
-					k = 15 // v maps to F
+				if e.(*sdl.KeyboardEvent).State == sdl.PRESSED {
+					hotkey := false
+					machineDo(func() {
+						hotkey = ioHotkey(e.(*sdl.KeyboardEvent).Keysym.Sym)
+					})
+					if hotkey {
+						continue
+					}
 				}
 
+				name := sdl.GetKeyName(e.(*sdl.KeyboardEvent).Keysym.Sym)
 				switch e.(*sdl.KeyboardEvent).State {
 				case sdl.PRESSED:
-					machineUpdateKeyboard(k, true)
+					machineSendKey(name, false, true)
 				case sdl.RELEASED:
-					machineUpdateKeyboard(k, false)
+					machineSendKey(name, false, false)
 				}
 
 			}
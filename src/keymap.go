@@ -0,0 +1,224 @@
+package main
+
+// Keyboard and game controller mapping
+//
+// The hex keypad of the COSMAC VIP is laid out as:
+//
+//	1 2 3 C
+//	4 5 6 D
+//	7 8 9 E
+//	A 0 B F
+//
+// and is mapped by default to the same block of keys on a QWERTY keyboard,
+// from 1 to V. Layouts map the same positions on AZERTY, QWERTZ and Dvorak
+// keyboards. Keys are named as SDL names them, in lower case without spaces
+// ("q", "space", "up", "keypad8"); the term frontend uses the characters
+// typed. Game controller buttons are named as SDL names them too ("a", "b",
+// "dpup", "leftshoulder", ...).
+//
+// The mapping is changed with the keymap command, or loaded from files of
+// keymap commands: ~/.chip8keys, then the file of the program stored next
+// to it with the .chip8keys extension. Keys and buttons not mapped are
+// ignored.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	KEYMAPFILE = ".chip8keys"
+)
+
+// keymapKeypad is the layout of the hex keypad.
+var keymapKeypad = [4][4]byte{
+	{0x1, 0x2, 0x3, 0xc},
+	{0x4, 0x5, 0x6, 0xd},
+	{0x7, 0x8, 0x9, 0xe},
+	{0xa, 0x0, 0xb, 0xf},
+}
+
+// keymapLayouts gives the keys at the positions of the keypad.
+var keymapLayouts = map[string][4][4]string{
+	"qwerty": {{"1", "2", "3", "4"}, {"q", "w", "e", "r"}, {"a", "s", "d", "f"}, {"z", "x", "c", "v"}},
+	"azerty": {{"&", "é", "\"", "'"}, {"a", "z", "e", "r"}, {"q", "s", "d", "f"}, {"w", "x", "c", "v"}},
+	"qwertz": {{"1", "2", "3", "4"}, {"q", "w", "e", "r"}, {"a", "s", "d", "f"}, {"y", "x", "c", "v"}},
+	"dvorak": {{"1", "2", "3", "4"}, {"'", ",", ".", "p"}, {"a", "o", "e", "u"}, {";", "q", "j", "k"}},
+}
+
+// keymap maps the keys and buttons to the keypad keys. By default, the D-pad
+// is mapped to the keys most programs use as arrows and the A and B buttons
+// to the keys next to them. The keys are mapped by keymapLayout.
+var keymap = struct {
+	keys    map[string]byte
+	buttons map[string]byte
+}{
+	keys: make(map[string]byte),
+	buttons: map[string]byte{
+		"dpup":    0x5,
+		"dpleft":  0x7,
+		"dpdown":  0x8,
+		"dpright": 0x9,
+		"a":       0x6,
+		"b":       0x4,
+	},
+}
+
+// keymapButton returns the keypad key mapped to a game controller button.
+func keymapButton(name string) (byte, bool) {
+	k, ok := keymap.buttons[keymapName(name)]
+	return k, ok
+}
+
+func keymapCommand(args []string) error {
+	if len(args) == 0 {
+		keymapShow()
+		return nil
+	}
+
+	switch args[0] {
+	case "layout":
+		if len(args) < 2 {
+			return errors.New("missing layout")
+		}
+		return keymapLayout(args[1])
+
+	case "key", "pad":
+		if len(args) < 3 {
+			return fmt.Errorf("missing %s name or keypad key", args[0])
+		}
+		mapping := keymap.keys
+		if args[0] == "pad" {
+			mapping = keymap.buttons
+		}
+		name := keymapName(args[1])
+		if args[2] == "none" {
+			delete(mapping, name)
+			return nil
+		}
+		k, err := strconv.ParseUint(args[2], 16, 4)
+		if err != nil {
+			return fmt.Errorf("invalid keypad key %s", args[2])
+		}
+		mapping[name] = byte(k)
+
+	case "load":
+		if len(args) < 2 {
+			return errors.New("missing file name")
+		}
+		return keymapLoad(args[1])
+
+	default:
+		return fmt.Errorf("invalid keymap command %s", args[0])
+	}
+	return nil
+}
+
+// keymapKey returns the keypad key mapped to a keyboard key.
+func keymapKey(name string) (byte, bool) {
+	k, ok := keymap.keys[keymapName(name)]
+	return k, ok
+}
+
+// keymapLayout maps the keypad to the keys of a keyboard layout, replacing
+// the keyboard mapping.
+func keymapLayout(name string) error {
+	layout, ok := keymapLayouts[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown layout %s, known layouts are azerty, dvorak, qwerty and qwertz", name)
+	}
+	keymap.keys = make(map[string]byte)
+	for row := range layout {
+		for column, key := range layout[row] {
+			keymap.keys[key] = keymapKeypad[row][column]
+		}
+	}
+	return nil
+}
+
+// keymapLoad executes the keymap commands of a file, one per line without
+// the keymap word:
+//
+//	layout azerty
+//	key up 5
+//	pad start f
+func keymapLoad(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "load" {
+			return fmt.Errorf("%s:%d: files cannot be loaded from keymap files", path, line)
+		}
+		if err := keymapCommand(fields); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// keymapLoadFiles loads ~/.chip8keys and the keymap file of the program if
+// they exist.
+func keymapLoadFiles(program string) error {
+	paths := []string{}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, KEYMAPFILE))
+	}
+	if program != "" {
+		paths = append(paths, strings.TrimSuffix(program, filepath.Ext(program))+KEYMAPFILE)
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := keymapLoad(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keymapName normalizes the name of a key or button.
+func keymapName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, " ", ""))
+}
+
+// keymapShow prints the keys and buttons mapped to every keypad key, in the
+// layout of the keypad.
+func keymapShow() {
+	mapped := func(mapping map[string]byte, k byte) string {
+		names := []string{}
+		for name, key := range mapping {
+			if key == k {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	for _, row := range keymapKeypad {
+		for _, k := range row {
+			line := fmt.Sprintf("%X: %s", k, mapped(keymap.keys, k))
+			if buttons := mapped(keymap.buttons, k); buttons != "" {
+				line += " (pad " + buttons + ")"
+			}
+			fmt.Println(line)
+		}
+	}
+}
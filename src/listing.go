@@ -0,0 +1,286 @@
+package main
+
+// Text program formats
+//
+// Besides binary images, programs can be loaded from text files, recognized
+// by being made of printable characters only, unless they cannot be decoded:
+//   - annotated listings like games/pong.txt, one instruction per line
+//     "0x22a: 0xa2ea LD I, 0x2ea ; LOOP: erase racket sprites", whose
+//     comments and register notes are read as symbols;
+//   - Intel HEX files, every line being a ":LLAAAATT...CC" record;
+//   - hex dumps, lines of bytes ("6a 02") or words ("6a02", "0x6a02")
+//     optionally preceded by their address and a colon ("0x200: 6a02 6b0c").
+//
+// Comments start with ; or #. When the lowest address is 0x200 or more,
+// addresses are absolute; otherwise they are relative to the start of the
+// program. Gaps between the lines are filled with zeros.
+//
+// The listing command writes memory back as an annotated listing, with the
+// labels and register notes of the symbols, that can be loaded again.
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	listingAddress = regexp.MustCompile(`^\s*(?:0x)?([0-9a-fA-F]{1,5})\s*:\s*(.*)$`)
+	listingHex     = regexp.MustCompile(`^(?:0x)?(?:[0-9a-fA-F]{2}|[0-9a-fA-F]{4})$`)
+)
+
+// listingCommand writes memory from start (default 0x200) to end (default
+// the last non-zero byte) as an annotated listing.
+func listingCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing file name")
+	}
+	start := uint16(MEMPROGRAMSTART)
+	end := uint16(MEMEND)
+	for end > start && m.memory[end-1] == 0 {
+		end--
+	}
+	var err error
+	if len(args) > 1 {
+		if start, err = cliParseNumber(args[1]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 2 {
+		if end, err = cliParseNumber(args[2]); err != nil {
+			return err
+		}
+	}
+	if start%2 != 0 || start >= MEMEND || end > MEMEND || end < start {
+		return errors.New("invalid address range")
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if err := listingWrite(w, start, end); err != nil {
+		file.Close()
+		return err
+	}
+	fmt.Printf("Wrote 0x%03x-0x%03x to %s\n", start, end, args[0])
+	return file.Close()
+}
+
+// listingDecode returns the image of a program given as text, and whether it
+// was an annotated listing. The image is nil if data is not text, or if it
+// is not a program in any of the text formats: binary programs can be made
+// of printable characters only, so they are loaded as they are, with a
+// warning in case a text file was meant.
+func listingDecode(data []byte) ([]byte, bool, error) {
+	if !listingIsText(data) {
+		return nil, false, nil
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	intelHex := false
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			intelHex = strings.HasPrefix(line, ":")
+			break
+		}
+	}
+
+	var image []byte
+	var listing bool
+	var err error
+	if intelHex {
+		image, err = listingIntelHex(lines)
+	} else {
+		image, listing, err = listingHexDump(lines)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: loading the program as binary, it is not a text program: %v\n", err)
+		return nil, false, nil
+	}
+	return image, listing, nil
+}
+
+// listingHexDump decodes hex dumps and annotated listings, where only the
+// address and the opcode of each line are used.
+func listingHexDump(lines []string) ([]byte, bool, error) {
+	memory := make(map[int]byte)
+	listing := false
+	address := 0
+	for n, line := range lines {
+		if i := strings.IndexAny(line, ";#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" || symbolsDefinition.MatchString(line) {
+			continue
+		}
+
+		addressed := false
+		if match := listingAddress.FindStringSubmatch(line); match != nil {
+			a, _ := strconv.ParseUint(match[1], 16, 32)
+			address = int(a)
+			line = match[2]
+			addressed = true
+		}
+
+		tokens := strings.Fields(line)
+		values := []string{}
+		for _, token := range tokens {
+			if !listingHex.MatchString(token) {
+				break
+			}
+			values = append(values, strings.TrimPrefix(token, "0x"))
+		}
+		if len(values) < len(tokens) {
+			// an instruction follows the opcode in listings
+			if !addressed || len(values) == 0 || len(values[0]) != 4 {
+				return nil, false, fmt.Errorf("line %d: invalid hex dump or listing line", n+1)
+			}
+			values = values[:1]
+			listing = true
+		}
+
+		for _, value := range values {
+			b, _ := hex.DecodeString(value)
+			for _, v := range b {
+				memory[address] = v
+				address++
+			}
+		}
+	}
+	image, err := listingImage(memory)
+	return image, listing, err
+}
+
+// listingImage returns the image made of the bytes at their addresses.
+func listingImage(memory map[int]byte) ([]byte, error) {
+	if len(memory) == 0 {
+		return []byte{}, nil
+	}
+	low, high := -1, 0
+	for address := range memory {
+		if low < 0 || address < low {
+			low = address
+		}
+		if address > high {
+			high = address
+		}
+	}
+	base := 0
+	if low >= MEMPROGRAMSTART {
+		base = MEMPROGRAMSTART
+	}
+	if high-base >= MEMEND {
+		return nil, fmt.Errorf("address 0x%x out of memory", high)
+	}
+
+	image := make([]byte, high-base+1)
+	for address, b := range memory {
+		image[address-base] = b
+	}
+	return image, nil
+}
+
+// listingIntelHex decodes Intel HEX records: data (00), end of file (01),
+// extended segment address (02) and extended linear address (04).
+func listingIntelHex(lines []string) ([]byte, error) {
+	memory := make(map[int]byte)
+	base := 0
+	for n, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		record, err := hex.DecodeString(strings.TrimPrefix(line, ":"))
+		if !strings.HasPrefix(line, ":") || err != nil || len(record) < 5 || len(record) != int(record[0])+5 {
+			return nil, fmt.Errorf("line %d: invalid Intel HEX record", n+1)
+		}
+		var sum byte
+		for _, b := range record {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("line %d: checksum mismatch", n+1)
+		}
+
+		data := record[4 : len(record)-1]
+		switch record[3] {
+		case 0x00:
+			address := base + int(record[1])<<8 + int(record[2])
+			for i, b := range data {
+				memory[address+i] = b
+			}
+		case 0x01:
+			return listingImage(memory)
+		case 0x02, 0x04:
+			if len(data) != 2 {
+				return nil, fmt.Errorf("line %d: invalid address record", n+1)
+			}
+			base = int(data[0])<<8 + int(data[1])
+			if record[3] == 0x02 {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unsupported record type %02X", n+1, record[3])
+		}
+	}
+	return listingImage(memory)
+}
+
+// listingIsText tells whether data is made of printable characters and
+// white space only.
+func listingIsText(data []byte) bool {
+	if len(data) == 0 || !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// listingWrite writes the instructions from start to end, the register notes
+// in a header and the labels in the comments, or as definitions when they
+// cannot be written as comments.
+func listingWrite(w *bufio.Writer, start uint16, end uint16) error {
+	for x := byte(0); x < 16; x++ {
+		if note, ok := symbolsRegister(x); ok {
+			fmt.Fprintf(w, "; V%X - %s\n", x, note)
+		}
+	}
+	fmt.Fprintln(w)
+
+	for address := start; address < end; address += 2 {
+		comments := []string{}
+		if label, ok := symbolsLabel(address); ok {
+			if symbolsCommentLabel.MatchString(label + ":") {
+				comments = append(comments, label+":")
+			} else {
+				fmt.Fprintf(w, "%s = 0x%03x\n", label, address)
+			}
+		}
+		text := disasmFormat(address, "cowgod")
+		if kinds, ok := coverageData(address); ok {
+			text = disasmFormatData(address, "cowgod")
+			comments = append(comments, kinds)
+		}
+		line := fmt.Sprintf("0x%03x: 0x%04x %-18s", address, machineGetInstruction(address), text)
+		if len(comments) > 0 {
+			line += " ; " + strings.Join(comments, " ")
+		}
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestListingIntelHex(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		image  []byte
+		err    string
+	}{
+		{"data", ":040200006A02A2EA02\n:00000001FF", []byte{0x6a, 0x02, 0xa2, 0xea}, ""},
+		{"relative", ":0200000000E01E\n:00000001FF", []byte{0x00, 0xe0}, ""},
+		{"gap", ":0102000012EB\n:0102030034C6\n:00000001FF", []byte{0x12, 0, 0, 0x34}, ""},
+		{"segment address", ":020000020020DC\n:0200000000E01E\n:00000001FF", []byte{0x00, 0xe0}, ""},
+		{"without end of file", "\n:0200000000E01E\r\n\n", []byte{0x00, 0xe0}, ""},
+		{"after end of file", ":0200000000E01E\n:00000001FF\nignored", []byte{0x00, 0xe0}, ""},
+		{"lowercase", ":0200000000e01e", []byte{0x00, 0xe0}, ""},
+		{"bad checksum", ":040200006A02A2EA03", nil, "line 1: checksum mismatch"},
+		{"bad checksum later", ":0200000000E01E\n:0102030034C7", nil, "line 2: checksum mismatch"},
+		{"truncated record", ":040200006A02A2", nil, "line 1: invalid Intel HEX record"},
+		{"truncated header", ":0402", nil, "line 1: invalid Intel HEX record"},
+		{"odd digits", ":040200006A02A2EA0", nil, "line 1: invalid Intel HEX record"},
+		{"not a record", ":0200000000E01E\n6a02", nil, "line 2: invalid Intel HEX record"},
+		{"unsupported record", ":0400000300000200F7", nil, "line 1: unsupported record type 03"},
+		{"invalid address record", ":0100000400FB", nil, "line 1: invalid address record"},
+		{"linear address out of memory", ":020000040001F9\n:0100000000FF", nil, "address 0x10000 out of memory"},
+		{"address out of memory", ":0100000000FF\n:0110000000EF", nil, "address 0x1000 out of memory"},
+	}
+	for _, test := range tests {
+		image, err := listingIntelHex(strings.Split(test.source, "\n"))
+		listingTestCheck(t, test.name, image, err, test.image, test.err)
+	}
+}
+
+func TestListingHexDump(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		image   []byte
+		listing bool
+		err     string
+	}{
+		{"bytes", "6a 02 a2 ea", []byte{0x6a, 0x02, 0xa2, 0xea}, false, ""},
+		{"words", "6a02 0xa2ea\n00E0", []byte{0x6a, 0x02, 0xa2, 0xea, 0x00, 0xe0}, false, ""},
+		{"addresses", "0x200: 6a02\n0x204: 00e0", []byte{0x6a, 0x02, 0, 0, 0x00, 0xe0}, false, ""},
+		{"relative addresses", "2: 00e0", []byte{0, 0, 0x00, 0xe0}, false, ""},
+		{"comments", "# header\n\n6a02 ; set va\n; end", []byte{0x6a, 0x02}, false, ""},
+		{"listing", "0x200: 0x6a02 LD VA, 0x02 ; START\n0x202: 0x00ee RET",
+			[]byte{0x6a, 0x02, 0x00, 0xee}, true, ""},
+		{"definitions", "START = 0x200\n0x200: 0x1200 JP START", []byte{0x12, 0x00}, true, ""},
+		{"empty", "\n# nothing\n", []byte{}, false, ""},
+		{"instruction without address", "6a02 LD VA, 0x02", nil, false, "line 1: invalid hex dump or listing line"},
+		{"byte opcode", "0x200: 6a LD VA, 0x02", nil, false, "line 1: invalid hex dump or listing line"},
+		{"truncated word", "6a02\n0x202: 00e", nil, false, "line 2: invalid hex dump or listing line"},
+		{"address out of memory", "0x0: 00\n0x1000: 00", nil, false, "address 0x1000 out of memory"},
+		{"program out of memory", "0x11ff: 00 00", nil, false, "address 0x1200 out of memory"},
+	}
+	for _, test := range tests {
+		image, listing, err := listingHexDump(strings.Split(test.source, "\n"))
+		listingTestCheck(t, test.name, image, err, test.image, test.err)
+		if err == nil && listing != test.listing {
+			t.Errorf("%s: got listing %t, expected %t", test.name, listing, test.listing)
+		}
+	}
+}
+
+func TestListingDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		image   []byte
+		listing bool
+	}{
+		{"intel hex", []byte(":0200000000E01E\r\n:00000001FF\r\n"), []byte{0x00, 0xe0}, false},
+		{"hex dump", []byte("00e0 1200\n"), []byte{0x00, 0xe0, 0x12, 0x00}, false},
+		{"listing", []byte("0x200: 0x00e0 CLS\n"), []byte{0x00, 0xe0}, true},
+		// binary programs, or text that is not a program, are loaded as
+		// they are
+		{"binary", []byte{0x00, 0xe0, 0x12, 0x00}, nil, false},
+		{"printable binary", []byte("a2e!"), nil, false},
+		{"bad intel hex", []byte(":0200000000E01F\n"), nil, false},
+	}
+	for _, test := range tests {
+		image, listing, err := listingDecode(test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(image, test.image) || (image == nil) != (test.image == nil) {
+			t.Errorf("%s: got % x, expected % x", test.name, image, test.image)
+		}
+		if listing != test.listing {
+			t.Errorf("%s: got listing %t, expected %t", test.name, listing, test.listing)
+		}
+	}
+}
+
+// listingTestCheck compares the image or the error of a decoder with the
+// expected ones.
+func listingTestCheck(t *testing.T, name string, image []byte, err error, expected []byte, expectedErr string) {
+	t.Helper()
+	if expectedErr != "" {
+		if err == nil || !strings.Contains(err.Error(), expectedErr) {
+			t.Errorf("%s: got error %v, expected %q", name, err, expectedErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if !bytes.Equal(image, expected) {
+		t.Errorf("%s: got % x, expected % x", name, image, expected)
+	}
+}
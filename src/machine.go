@@ -3,10 +3,16 @@ package main
 // add package description
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +28,7 @@ const (
 	MEMFONTS        = 0x000
 	MEMPROGRAMSTART = 0x200
 	MEMEND          = 0x1000
+	MEMPROGRAMSIZE  = MEMEND - MEMPROGRAMSTART
 	SCREENWIDTH     = 64
 	SCREENHEIGHT    = 32
 	SLEEPTIME       = 16666667 * time.Nanosecond
@@ -65,8 +72,49 @@ const (
 	ldbcd                 // Fx33 - LD B, Vx
 	save                  // Fx55 - LD [I], Vx
 	restore               // Fx65 - LD Vx, [I]
+	invalid               // any other word - DW word
 )
 
+// opcodeDescriptions gives the encoding and the mnemonic of each opcode.
+var opcodeDescriptions = [...]string{
+	sys:     "0nnn SYS addr",
+	cls:     "00E0 CLS",
+	ret:     "00EE RET",
+	jmp:     "1nnn JP addr",
+	call:    "2nnn CALL addr",
+	seb:     "3xkk SE Vx, byte",
+	sneb:    "4xkk SNE Vx, byte",
+	ser:     "5xy0 SE Vx, Vy",
+	ldb:     "6xkk LD Vx, byte",
+	addb:    "7xkk ADD Vx, byte",
+	ldr:     "8xy0 LD Vx, Vy",
+	or:      "8xy1 OR Vx, Vy",
+	and:     "8xy2 AND Vx, Vy",
+	xor:     "8xy3 XOR Vx, Vy",
+	addr:    "8xy4 ADD Vx, Vy",
+	sub:     "8xy5 SUB Vx, Vy",
+	shr:     "8xy6 SHR Vx {, Vy}",
+	subn:    "8xy7 SUBN Vx, Vy",
+	shl:     "8xyE SHL Vx {, Vy}",
+	sner:    "9xy0 SNE Vx, Vy",
+	ldi:     "Annn LD I, addr",
+	jpv:     "Bnnn JP V0, addr",
+	rnd:     "Cxkk RND Vx, byte",
+	drw:     "Dxyn DRW Vx, Vy, nibble",
+	skp:     "Ex9E SKP Vx",
+	sknp:    "ExA1 SKNP Vx",
+	gett:    "Fx07 LD Vx, DT",
+	ldk:     "Fx0A LD Vx, K",
+	sett:    "Fx15 LD DT, Vx",
+	lds:     "Fx18 LD ST, Vx",
+	addi:    "Fx1E ADD I, Vx",
+	ldf:     "Fx29 LD F, Vx",
+	ldbcd:   "Fx33 LD B, Vx",
+	save:    "Fx55 LD [I], Vx",
+	restore: "Fx65 LD Vx, [I]",
+	invalid: "???? DW word (invalid)",
+}
+
 type instruction struct {
 	op  opcode // Instruction opcode
 	nnn uint16 // (or addr) A 12-bit value, the lowest 12 bits of the instruction
@@ -97,17 +145,23 @@ type registers struct {
 // timers tick down at 60Hz, display refresh rate is 60Hz too. To get the
 // proper emulation speed and keep things simple, the main emulation loop runs
 // at 60Hz. For each iteration we execute 540 / 60 = 9 instructions, then we
-// decrease timers and refresh the display.
+// decrease timers and refresh the display. Some programs expect a different
+// speed, so the number of instructions per frame (ipf) can be changed, as
+// well as the quirks of the interpreter (see quirks.go).
 //
 // The cycles variable is not part of the original CHIP-8 machine, it's just an
 // artifact to keep track of how many instructions were executed in the current
-// loop iteration.
+// loop iteration. Likewise, dirty tells that CLS or DRW changed the pixmap
+// since it was last published to the frontends.
 type machine struct {
 	breakpoints []uint16
-	cycles      byte
+	cycles      int
+	dirty       bool
+	ipf         int
 	keyboard    [16]bool
 	pixmap      [SCREENWIDTH][SCREENHEIGHT]uint8
 	memory      [4096]byte
+	quirks      quirks
 	regs        registers
 	running     bool
 	stack       [16]uint16
@@ -115,6 +169,45 @@ type machine struct {
 
 var m machine
 
+// The machine is owned by a single emulation goroutine, machineLoop, which
+// runs the frames of a running machine at 60Hz and, between instructions,
+// executes the requests of the other goroutines: the commands of the CLI and
+// of the debugger servers (step, run, stop, poke...) and the key events of
+// the frontends. After every frame and every request, it publishes an
+// immutable snapshot of what the frontends show, and notifies them without
+// waiting: a frontend too slow to keep up only skips frames.
+type machineRequest struct {
+	do   func()
+	done chan struct{} // closed once do returned, nil if nobody waits
+}
+
+type machineSnapshot struct {
+	display    filterLevels // as shown, filters applied
+	version    uint64       // incremented whenever the display changes
+	palette    palette
+	settings   displaySettings
+	sounding   bool   // the machine runs with the sound timer set
+	breaks     uint64 // incremented whenever a run stops on a breakpoint
+	breakpoint uint16 // address of the last breakpoint reached
+}
+
+var machineRequests = make(chan machineRequest, 64)
+
+var machineLatest atomic.Pointer[machineSnapshot]
+
+// machineLoopState is only used by the emulation goroutine.
+var machineLoopState struct {
+	buzz    chan struct{} // notified at the end of every frame, see machineLoop
+	draw    chan struct{} // notified when the display may have changed
+	stopped chan bool     // outcome of the current run
+	resumed bool          // an instruction was executed since the run started
+	breaks  uint64        // runs stopped on a breakpoint
+}
+
+// machineOversize is the policy for programs too big for the memory: reject
+// or truncate.
+var machineOversize = "reject"
+
 var fonts [80]byte = [80]byte{
 	0xF0, 0x90, 0x90, 0x90, 0xF0, // 0
 	0x20, 0x60, 0x20, 0x20, 0x70, // 1
@@ -156,6 +249,17 @@ func machineDeleteBreakpoint(friendly int) {
 	}
 }
 
+// machineDeleteBreakpointAt removes the breakpoints set at address.
+func machineDeleteBreakpointAt(address uint16) {
+	breakpoints := m.breakpoints[:0]
+	for _, b := range m.breakpoints {
+		if b != address {
+			breakpoints = append(breakpoints, b)
+		}
+	}
+	m.breakpoints = breakpoints
+}
+
 func machineDisassembleInstruction(assembled uint16) (disassembled instruction) {
 	// Extract variables from the assembled instruction
 	// Obviously we won't need all of them, extra ones are just ignored
@@ -272,14 +376,37 @@ func machineDisassembleInstruction(assembled uint16) (disassembled instruction)
 		return instruction{op: restore, x: x}
 
 	default:
-		return instruction{}
-		//TODO: return instruction, error instead of just instruction
-		//TODO: return proper error in case instruction not recognized
+		return instruction{op: invalid, nnn: nnn}
 	}
 }
 
+// machineDo executes f on the emulation goroutine, between two
+// instructions, and waits for it to return. It must not be called by the
+// emulation goroutine itself.
+func machineDo(f func()) {
+	done := make(chan struct{})
+	machineRequests <- machineRequest{f, done}
+	<-done
+}
+
+// machineGetInstruction returns the instruction at address, the second byte
+// of an instruction at the end of the memory being the first one.
 func machineGetInstruction(address uint16) uint16 {
-	return uint16(m.memory[address])<<8 + uint16(m.memory[address+1])
+	return uint16(m.memory[address%MEMEND])<<8 + uint16(m.memory[(address+1)%MEMEND])
+}
+
+// machineHalt stops a running machine and tells the outcome of the run to
+// whoever started it.
+func machineHalt(hit bool) {
+	if !m.running {
+		return
+	}
+	m.running = false
+	if hit {
+		machineLoopState.breaks++
+	}
+	machineLoopState.stopped <- hit
+	machineLoopState.stopped = nil
 }
 
 func machineInitialize() {
@@ -287,33 +414,146 @@ func machineInitialize() {
 		m.memory[MEMFONTS+i] = v
 	}
 	m.breakpoints = make([]uint16, 0, 5)
+	m.ipf = DEFAULTIPF
+	m.quirks = defaultQuirks
 	machineReset()
 }
 
-func machineIsRunning() bool {
-	return m.running
+// machineLoadProgram loads a program file, "-" being the standard input,
+// applying the IPS or BPS patch file unless it is empty.
+func machineLoadProgram(program string, patch string) error {
+	var data []byte
+	var err error
+	if program == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(program)
+	}
+	if err != nil {
+		return err
+	}
+	source := ""
+	if program != "-" {
+		if source, err = filepath.Abs(program); err != nil {
+			return err
+		}
+	}
+	return machineLoad(data, source, patch)
+}
+
+// machineLoadProgramBytes loads a program, binary or text, in memory.
+func machineLoadProgramBytes(data []byte) error {
+	return machineLoad(data, "", "")
 }
 
-func machineLoadProgram(program string) {
+// machineLoad loads a binary image, an Octo cartridge or a program given as
+// text, source being the path of the program if it was read from a file, and
+// applies the patch file to it unless it is empty. The symbols of annotated listings replace
+// the current ones. Images larger than the memory available to programs are
+// rejected, or truncated if machineOversize is "truncate"; the memory is left
+// unchanged when the image is rejected. Empty images and images of an odd
+// size, which cannot be made of whole instructions, only produce a warning.
+func machineLoad(data []byte, source string, patch string) error {
+	var image []byte
+	var listing bool
+	var options *cartridgeOptions
+	var err error
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		image, options, err = cartridgeDecode(data)
+	} else {
+		image, listing, err = listingDecode(data)
+	}
+	if err != nil {
+		return err
+	}
+	if image == nil {
+		image = data
+	}
+	original := image
+	if patch != "" {
+		if image, err = patchApply(image, patch); err != nil {
+			return err
+		}
+	}
+	if len(image) > MEMPROGRAMSIZE {
+		if machineOversize != "truncate" {
+			return fmt.Errorf("program too big: %d bytes, at most %d bytes fit in memory", len(image), MEMPROGRAMSIZE)
+		}
+		fmt.Fprintf(os.Stderr, "warning: program truncated from %d to %d bytes\n", len(image), MEMPROGRAMSIZE)
+		image = image[:MEMPROGRAMSIZE]
+	}
+	switch {
+	case len(image) == 0:
+		fmt.Fprintln(os.Stderr, "warning: empty program")
+	case len(image)%2 != 0:
+		fmt.Fprintf(os.Stderr, "warning: odd program size (%d bytes)\n", len(image))
+	}
+
 	for i := MEMPROGRAMSTART; i < MEMEND; i++ {
 		m.memory[i] = 0
 	}
+	copy(m.memory[MEMPROGRAMSTART:], image)
+	patchOriginal = original
 
-	data, err := ioutil.ReadFile(program)
-	if err != nil {
-		log.Fatal(err)
+	if listing {
+		if err := symbolsRead(bytes.NewReader(data), source); err != nil {
+			return err
+		}
 	}
 
-	// TODO: check if program is too big
-	for i, v := range data {
-		m.memory[MEMPROGRAMSTART+i] = v
+	// apply the settings of the program from the ROM database, patched
+	// programs being identified as the original ones
+	if err := romdbIdentify(original); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 	}
+	// and the ones of Octo cartridges
+	if options != nil {
+		if err := cartridgeApply(options); err != nil {
+			fmt.Fprintf(os.Stderr, "cartridge: %v\n", err)
+		}
+	}
+	return nil
 }
 
 func machineListBreakpoints() []uint16 {
 	return m.breakpoints
 }
 
+// machineLoop is the emulation goroutine, see above. buzz is notified at the
+// end of every frame, when the sound is switched on or off and when a run
+// stops on a breakpoint, draw at the
+// end of every frame and when the display changes. It returns when ctx is
+// cancelled.
+func machineLoop(ctx context.Context, buzz chan struct{}, draw chan struct{}) {
+	machineLoopState.buzz = buzz
+	machineLoopState.draw = draw
+	ticker := time.NewTicker(SLEEPTIME)
+	defer ticker.Stop()
+
+	machinePublish(false)
+	for {
+		select {
+		case <-ctx.Done():
+			machineStop()
+			return
+
+		case request := <-machineRequests:
+			request.do()
+			if request.done != nil {
+				close(request.done)
+			}
+			machinePublish(false)
+
+		case <-ticker.C:
+			if m.running {
+				machineRunFrame()
+				// the display may have changed before a breakpoint
+				machinePublish(false)
+			}
+		}
+	}
+}
+
 func machinePlaySound() bool {
 	if m.regs.st > 0 {
 		return true
@@ -321,6 +561,45 @@ func machinePlaySound() bool {
 	return false
 }
 
+// machinePost executes f on the emulation goroutine without waiting for it.
+func machinePost(f func()) {
+	machineRequests <- machineRequest{do: f}
+}
+
+// machinePublish publishes the snapshot of the machine and notifies the
+// frontends, frame telling if a frame just ended.
+func machinePublish(frame bool) {
+	previous := machineSnapshotLatest()
+	s := *previous
+	s.palette = displayPalette
+	s.settings = display
+	s.sounding = m.running && machinePlaySound()
+	if machineLoopState.breaks != s.breaks {
+		s.breaks = machineLoopState.breaks
+		s.breakpoint = m.regs.pc
+	}
+	changed := filterTakeDirty()
+	if changed {
+		s.display = filterOutput()
+		s.version++
+	}
+	machineLatest.Store(&s)
+
+	notify := func(c chan struct{}) {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+	if frame || s.sounding != previous.sounding || s.breaks != previous.breaks {
+		notify(machineLoopState.buzz)
+	}
+	if frame || changed {
+		notify(machineLoopState.draw)
+	}
+	displayNotify()
+}
+
 func machineReset() {
 	for i, _ := range m.keyboard {
 		m.keyboard[i] = false
@@ -333,7 +612,7 @@ func machineReset() {
 	m.regs.sp = 16
 
 	m.cycles = 0
-	m.running = false
+	machineStop()
 	rand.Seed(time.Now().UnixNano())
 
 	for x := 0; x < 64; x++ {
@@ -341,46 +620,118 @@ func machineReset() {
 			m.pixmap[x][y] = 0
 		}
 	}
+	m.dirty = true
+	filterReset()
 }
 
-func machineRun(buzz chan struct{}, draw chan struct{}, stop chan struct{}) {
+// machineRun starts running the machine on the emulation goroutine. The
+// channel returned receives true if the machine stops on a breakpoint, false
+// if it is stopped by machineStop.
+//
+// The breakpoint at the current address, if any, is ignored so that running
+// again after a breakpoint resumes execution instead of stopping right away.
+func machineRun() <-chan bool {
+	machineStop()
+	stopped := make(chan bool, 1)
+	machineLoopState.stopped = stopped
+	machineLoopState.resumed = false
 	m.running = true
-	for {
-		for i := m.cycles; i < 9; i++ {
-			for i := 0; i < len(m.breakpoints); i++ {
-				if m.regs.pc == m.breakpoints[i] {
-					fmt.Printf("Found breakpoint at 0x%03x\n", m.regs.pc)
-					m.running = false
-					return
-				}
-			}
+	return stopped
+}
 
-			// we received a stop token from the CLI
-			// dequeue it and exit the run
-			if (len(stop)) == 1 {
-				<-stop
-				m.running = false
+// machineRunFrame executes the instructions left in the current frame of a
+// running machine, stopping at the first breakpoint reached.
+func machineRunFrame() {
+	for i := m.cycles; i < m.ipf && m.running; i++ {
+		for _, address := range m.breakpoints {
+			if m.regs.pc == address && machineLoopState.resumed {
+				fmt.Printf("Found breakpoint at 0x%03x\n", m.regs.pc)
+				machineHalt(true)
 				return
 			}
+		}
+		machineLoopState.resumed = true
+		machineStep()
+	}
+}
 
-			machineStep(buzz, draw)
+// machineSetRegister sets a register given its name: v0 to vf, i, pc, sp,
+// dt or st. PC and SP values that the next instruction could not use
+// without going out of the memory or the stack are rejected.
+func machineSetRegister(name string, value uint16) error {
+	register := strings.ToLower(name)
+	switch register {
+	case "i":
+		m.regs.i = value
+	case "pc":
+		if value > MEMEND-2 {
+			return fmt.Errorf("invalid pc 0x%x, expected at most 0x%x", value, MEMEND-2)
+		}
+		m.regs.pc = value
+	case "sp":
+		if int(value) > len(m.stack) {
+			return fmt.Errorf("invalid sp %d, expected at most %d", value, len(m.stack))
 		}
-		time.Sleep(SLEEPTIME)
+		m.regs.sp = byte(value)
+	case "dt":
+		m.regs.dt = byte(value)
+	case "st":
+		m.regs.st = byte(value)
+	default:
+		if len(register) != 2 || register[0] != 'v' {
+			return fmt.Errorf("invalid register %s", name)
+		}
+		x, err := strconv.ParseUint(register[1:], 16, 4)
+		if err != nil {
+			return fmt.Errorf("invalid register %s", name)
+		}
+		m.regs.v[x] = byte(value)
 	}
+	return nil
 }
 
-func machineStep(buzz chan struct{}, draw chan struct{}) {
+// machineSendKey presses or releases the keypad key mapped to a key of the
+// keyboard, or to a button of a game controller, from a frontend. The name is
+// mapped by the emulation goroutine, which owns the keymap, without waiting
+// for it. Keys not mapped to the keypad are ignored.
+func machineSendKey(name string, button bool, state bool) {
+	machinePost(func() {
+		k, ok := keymapKey(name)
+		if button {
+			k, ok = keymapButton(name)
+		}
+		if ok {
+			machineUpdateKeyboard(k, state)
+		}
+	})
+}
+
+// machineSnapshotLatest returns the latest snapshot published, which must
+// not be modified.
+func machineSnapshotLatest() *machineSnapshot {
+	if s := machineLatest.Load(); s != nil {
+		return s
+	}
+	return &machineSnapshot{}
+}
+
+func machineStep() {
 	incrementPC := true
 	instruction := machineDisassembleInstruction(machineGetInstruction(m.regs.pc))
+	profileInstruction(m.regs.pc, instruction)
+	coverageMark(m.regs.pc, 2, COVEXECUTED)
 
 	switch {
-	case instruction.op == sys:
+	case instruction.op == sys || instruction.op == invalid:
 		// ignore and do nothing
 
 	case instruction.op == cls:
 		for x := 0; x < 64; x++ {
 			for y := 0; y < 32; y++ {
-				m.pixmap[x][y] = 0
+				if m.pixmap[x][y] != 0 {
+					m.pixmap[x][y] = 0
+					m.dirty = true
+				}
 			}
 		}
 
@@ -433,12 +784,21 @@ func machineStep(buzz chan struct{}, draw chan struct{}) {
 
 	case instruction.op == or:
 		m.regs.v[instruction.x] |= m.regs.v[instruction.y]
+		if m.quirks.vfReset {
+			m.regs.v[0xf] = 0
+		}
 
 	case instruction.op == and:
 		m.regs.v[instruction.x] &= m.regs.v[instruction.y]
+		if m.quirks.vfReset {
+			m.regs.v[0xf] = 0
+		}
 
 	case instruction.op == xor:
 		m.regs.v[instruction.x] ^= m.regs.v[instruction.y]
+		if m.quirks.vfReset {
+			m.regs.v[0xf] = 0
+		}
 
 	case instruction.op == addr:
 		m.regs.v[instruction.x] += m.regs.v[instruction.y]
@@ -452,6 +812,9 @@ func machineStep(buzz chan struct{}, draw chan struct{}) {
 		m.regs.v[instruction.x] -= m.regs.v[instruction.y]
 
 	case instruction.op == shr:
+		if !m.quirks.shift {
+			m.regs.v[instruction.x] = m.regs.v[instruction.y]
+		}
 		if m.regs.v[instruction.x]&0x01 == 1 {
 			m.regs.v[0xf] = 1
 		} else {
@@ -468,6 +831,9 @@ func machineStep(buzz chan struct{}, draw chan struct{}) {
 		m.regs.v[instruction.x] = m.regs.v[instruction.y] - m.regs.v[instruction.x]
 
 	case instruction.op == shl:
+		if !m.quirks.shift {
+			m.regs.v[instruction.x] = m.regs.v[instruction.y]
+		}
 		if m.regs.v[instruction.x]>>7 == 1 {
 			m.regs.v[0xf] = 1
 		} else {
@@ -484,7 +850,11 @@ func machineStep(buzz chan struct{}, draw chan struct{}) {
 		m.regs.i = instruction.nnn
 
 	case instruction.op == jpv:
-		m.regs.pc = uint16(m.regs.v[0x0]) + instruction.nnn
+		if m.quirks.jumping {
+			m.regs.pc = uint16(m.regs.v[instruction.nnn>>8]) + instruction.nnn
+		} else {
+			m.regs.pc = uint16(m.regs.v[0x0]) + instruction.nnn
+		}
 		incrementPC = false
 
 	case instruction.op == rnd:
@@ -492,18 +862,29 @@ func machineStep(buzz chan struct{}, draw chan struct{}) {
 
 	case instruction.op == drw:
 		m.regs.v[0xf] = 0
+		coverageMark(m.regs.i, int(instruction.n), COVSPRITE)
+		spriteRecord(m.regs.i, instruction.n)
 
 		for j := uint16(0); j < uint16(instruction.n); j++ {
 			y := (uint16(m.regs.v[instruction.y]) + j)
+			if !m.quirks.clipping {
+				y %= SCREENHEIGHT
+			}
 			if y < SCREENHEIGHT {
 				for i := uint16(0); i < 8; i++ {
 					x := (uint16(m.regs.v[instruction.x]) + i)
+					if !m.quirks.clipping {
+						x %= SCREENWIDTH
+					}
 					if x < SCREENWIDTH {
 						p := &m.pixmap[x][y]
 						n := (m.memory[m.regs.i+j] >> (8 - (i + 1))) & 0x1
 
 						old := *p
 						*p ^= n
+						if n != 0 {
+							m.dirty = true
+						}
 						if old > *p {
 							m.regs.v[0xf] = 1
 						}
@@ -526,14 +907,15 @@ func machineStep(buzz chan struct{}, draw chan struct{}) {
 		m.regs.v[instruction.x] = m.regs.dt
 
 	case instruction.op == ldk:
-		for {
-			for i, _ := range m.keyboard {
-				if m.keyboard[i] {
-					m.regs.v[instruction.x] = byte(i)
-					break
-				}
+		// without a key down, the instruction is executed again so that
+		// the emulation goroutine keeps receiving the key events
+		incrementPC = false
+		for i, pressed := range m.keyboard {
+			if pressed {
+				m.regs.v[instruction.x] = byte(i)
+				incrementPC = true
+				break
 			}
-			time.Sleep(1000000)
 		}
 
 	case instruction.op == sett:
@@ -548,30 +930,45 @@ func machineStep(buzz chan struct{}, draw chan struct{}) {
 	case instruction.op == ldf:
 		// TODO: check value in register is not bigger than 0xf
 		m.regs.i = uint16(m.regs.v[instruction.x]) * 5
+		coverageMark(m.regs.i, 5, COVREAD)
 
 	case instruction.op == ldbcd:
 		n := m.regs.v[instruction.x]
+		coverageMark(m.regs.i, 3, COVWRITTEN)
 		m.memory[m.regs.i], n = n/100, n%100
 		m.memory[m.regs.i+1], n = n/10, n%10
 		m.memory[m.regs.i+2] = n
 
 	case instruction.op == save:
+		coverageMark(m.regs.i, int(instruction.x)+1, COVWRITTEN)
 		for j := uint16(0); j <= uint16(instruction.x); j++ {
 			m.memory[m.regs.i+j] = m.regs.v[j]
 		}
+		if m.quirks.memory {
+			m.regs.i += uint16(instruction.x) + 1
+		}
 
 	case instruction.op == restore:
+		coverageMark(m.regs.i, int(instruction.x)+1, COVREAD)
 		for j := uint16(0); j <= uint16(instruction.x); j++ {
 			m.regs.v[j] = m.memory[m.regs.i+j]
 		}
+		if m.quirks.memory {
+			m.regs.i += uint16(instruction.x) + 1
+		}
 	}
 
 	if incrementPC {
 		m.regs.pc += 2
 	}
+	// PC wraps around the end of the memory like the addresses of the
+	// instructions
+	m.regs.pc %= MEMEND
 
 	m.cycles++
-	if m.cycles == 9 {
+	if m.cycles >= m.ipf {
+		// the beeper sounded during the frame if the sound timer was set
+		beeping := machinePlaySound()
 		if m.regs.dt > 0 {
 			m.regs.dt--
 		}
@@ -579,11 +976,28 @@ func machineStep(buzz chan struct{}, draw chan struct{}) {
 			m.regs.st--
 		}
 		m.cycles = 0
-		buzz <- struct{}{}
-		draw <- struct{}{}
+		profileFrame()
+		filterFrameTick()
+		captureFrameTick()
+		audioFrameTick(beeping)
+		machinePublish(true)
 	}
 }
 
+// machineStop stops the machine if it is running.
+func machineStop() {
+	machineHalt(false)
+}
+
+// machineTakeDirty tells if the pixmap changed since the last call.
+func machineTakeDirty() bool {
+	dirty := m.dirty
+	m.dirty = false
+	return dirty
+}
+
+// machineUpdateKeyboard presses or releases a key of the keypad, on the
+// emulation goroutine.
 func machineUpdateKeyboard(key byte, state bool) {
 	m.keyboard[key] = state
 }
@@ -3,25 +3,240 @@ package main
 // add package description
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// batchFlag collects the -x and -ex flags in the order they were given.
+type batchFlag struct {
+	commands *[]cliBatchCommand
+	script   bool
+}
+
+func (b batchFlag) String() string {
+	return ""
+}
+
+func (b batchFlag) Set(value string) error {
+	*b.commands = append(*b.commands, cliBatchCommand{value, b.script})
+	return nil
+}
+
 func main() {
-	if i := len(os.Args); i != 2 {
+	var batch []cliBatchCommand
+	flag.Var(batchFlag{&batch, true}, "x", "execute debugger commands from `file`, then exit")
+	flag.Var(batchFlag{&batch, false}, "ex", "execute debugger `command`, then exit")
+	gdb := flag.String("gdb", "", "serve the GDB remote protocol on `address` (e.g. :1234) instead of the CLI")
+	dap := flag.String("dap", "", "serve the Debug Adapter Protocol on `address` (e.g. :4711) instead of the CLI")
+	rpc := flag.String("rpc", "", "serve the JSON-RPC control API on `address` (unix:/path or host:port)")
+	frontend := flag.String("frontend", "sdl", "`frontend` used to display and play the machine: sdl, term or headless")
+	glyphs := flag.String("term-glyphs", "blocks", "characters drawing the display with the term frontend: blocks or braille")
+	keyTimeout := flag.Duration("key-timeout", 200*time.Millisecond, "with the term frontend, release keypad keys not received for this long")
+	scale := flag.Int("scale", display.scale, "size of a display pixel in the SDL window")
+	paletteName := flag.String("palette", "bw", "display `palette`: "+strings.Join(paletteNames(), ", "))
+	fg := flag.String("fg", "", "color of lit pixels, as #rrggbb")
+	bg := flag.String("bg", "", "color of unlit pixels, as #rrggbb")
+	scaling := flag.String("scaling", display.scaling, "`filter` scaling the display in the SDL window: nearest, linear or best")
+	vsync := flag.Bool("vsync", false, "synchronize the SDL window with the vertical blank of the monitor")
+	fullscreen := flag.Bool("fullscreen", false, "start the SDL window in fullscreen mode")
+	wave := flag.String("wave", audio.waveform, "`waveform` of the beeper: square or sine")
+	pitch := flag.String("pitch", "440", "pitch of the beeper in `Hz`")
+	volume := flag.String("volume", "25", "volume of the beeper, from 0 to 100")
+	mute := flag.Bool("mute", false, "mute the beeper")
+	ipf := flag.String("ipf", strconv.Itoa(DEFAULTIPF), "instructions executed per 60Hz frame")
+	quirkList := flag.String("quirks", strings.Join(quirksEnabled(defaultQuirks), ","), "comma separated `quirks` to turn on: "+strings.Join(quirkNames(), ", "))
+	flag.StringVar(&machineOversize, "oversize", machineOversize, "what to do with programs too big for the memory: reject or truncate")
+	patch := flag.String("patch", "", "apply the IPS or BPS `patch` to the program when loading it")
+	layout := flag.String("layout", "qwerty", "keyboard `layout` mapped to the keypad: qwerty, azerty, qwertz or dvorak")
+	noInit := flag.Bool("nx", false, "do not execute commands from ~/"+RCFILE+" and from the "+RCFILE+" file of the program")
+	programInit := flag.Bool("rc", false, "also execute the commands of the "+RCFILE+" file of the program, stored next to it")
+	flag.DurationVar(&cliTimeout, "timeout", cliTimeout, "how long a scripted run waits for a breakpoint")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] program\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [options] xref program\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "The program is read from the standard input if it is -.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// chip8 xref <program> prints the cross references of a program
+	if flag.NArg() == 2 && flag.Arg(0) == "xref" {
+		os.Exit(xrefMain(flag.Arg(1), *patch))
+	}
+
+	// with the DAP server, the program can be given by the launch request
+	if flag.NArg() != 1 && (*dap == "" || flag.NArg() > 1) {
 		fmt.Println("Missing argument")
 		os.Exit(1)
 	}
-	program := os.Args[1]
 
-	ioInit()
+	if machineOversize != "reject" && machineOversize != "truncate" {
+		fmt.Printf("Unknown oversize policy %s\n", machineOversize)
+		os.Exit(1)
+	}
+
+	settings := [][2]string{{"scale", strconv.Itoa(*scale)}, {"scaling", *scaling}, {"palette", *paletteName}}
+	if *fg != "" {
+		settings = append(settings, [2]string{"fg", *fg})
+	}
+	if *bg != "" {
+		settings = append(settings, [2]string{"bg", *bg})
+	}
+	if *fullscreen {
+		settings = append(settings, [2]string{"fullscreen", "on"})
+	}
+	for _, setting := range settings {
+		if err := displaySet(setting[0], setting[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	// options given explicitly override the ROM database
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for _, setting := range [][2]string{{"wave", *wave}, {"pitch", *pitch}, {"volume", *volume}} {
+		if err := audioSet(setting[0], setting[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	audio.muted = *mute
+
+	if err := keymapLayout(*layout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var input io.Reader = os.Stdin
+	switch *frontend {
+	case "sdl":
+		if err := ioInit(*vsync); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "term":
+		var err error
+		if input, err = termInit(*glyphs, *keyTimeout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "headless":
+	default:
+		fmt.Printf("Unknown frontend %s\n", *frontend)
+		os.Exit(1)
+	}
 	machineInitialize()
-	machineLoadProgram(program)
-	buzz := make(chan struct{})
-	draw := make(chan struct{})
-
-	go ioRunBuzzer(buzz)
-	go ioRunDisplay(draw)
-	go ioRunKeyboard()
-	cliRun(buzz, draw)
+	if err := ipfSet(*ipf); err != nil {
+		termRestore()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	q, err := quirksParse(*quirkList)
+	if err != nil {
+		termRestore()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	m.quirks = q
+	// the settings are restored before loading other programs
+	cliDefaults, cliExplicit = cliSaveSettings(), explicit
+	if flag.NArg() == 1 {
+		if err := machineLoadProgram(flag.Arg(0), *patch); err != nil {
+			termRestore()
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	cliOverrideSettings()
+	// the keymap files override the layout and the ROM database
+	if err := keymapLoadFiles(flag.Arg(0)); err != nil {
+		termRestore()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// the machine notifies the frontends without waiting for them, a slow
+	// frontend only skipping frames
+	ioBuzz := make(chan struct{}, 1)
+	ioDraw := make(chan struct{}, 1)
+
+	// the emulation goroutine and the frontends stop when ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	start := func(f func()) {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			f()
+		}()
+	}
+	shutdown := func(code int) {
+		cancel()
+		running.Wait()
+		termRestore()
+		os.Exit(code)
+	}
+
+	switch *frontend {
+	case "headless":
+		start(func() { headlessRun(ctx, ioBuzz, ioDraw) })
+	case "term":
+		start(func() { termRunBuzzer(ctx, ioBuzz) })
+		start(func() { termRunDisplay(ctx, ioDraw) })
+	default:
+		start(func() { ioRunDisplay(ctx, ioBuzz, ioDraw) })
+		go ioRunKeyboard(ctx)
+	}
+
+	buzz, draw := ioBuzz, ioDraw
+	if *rpc != "" {
+		// the machine ticks go through the RPC server which notifies its
+		// clients before passing them on to the frontend
+		buzz, draw = make(chan struct{}, 1), make(chan struct{}, 1)
+		start(func() { rpcForward(ctx, buzz, draw, ioBuzz, ioDraw) })
+		go func() {
+			if err := rpcServe(*rpc); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				shutdown(1)
+			}
+		}()
+	}
+	start(func() { machineLoop(ctx, buzz, draw) })
+
+	// the commands of the program can write files, so they are only executed
+	// when asked for
+	program := ""
+	if *programInit {
+		program = flag.Arg(0)
+	}
+	if !*noInit && cliSourceInit(program) == cliQuit {
+		shutdown(0)
+	}
+	if *gdb != "" {
+		if err := gdbServe(*gdb); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			shutdown(1)
+		}
+	}
+	if *dap != "" {
+		if err := dapServe(*dap); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			shutdown(1)
+		}
+	}
+	if len(batch) > 0 {
+		shutdown(cliRunBatch(batch))
+	}
+	cliRun(input)
+	shutdown(0)
 }
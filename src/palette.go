@@ -0,0 +1,62 @@
+package main
+
+// Display palettes
+//
+// A palette gives the colors of the unlit and lit pixels. Screenshots and
+// recordings use the display palette unless another one is requested. The
+// vip and hp48 presets mimic a COSMAC VIP on a television set and the LCD
+// of the HP48 calculators.
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image/color"
+	"sort"
+	"strings"
+)
+
+type palette struct {
+	background color.RGBA
+	foreground color.RGBA
+}
+
+var palettes = map[string]palette{
+	"bw":    {color.RGBA{0x00, 0x00, 0x00, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}},
+	"green": {color.RGBA{0x0a, 0x1a, 0x0a, 0xff}, color.RGBA{0x33, 0xff, 0x66, 0xff}},
+	"amber": {color.RGBA{0x1a, 0x10, 0x00, 0xff}, color.RGBA{0xff, 0xb0, 0x00, 0xff}},
+	"vip":   {color.RGBA{0x18, 0x18, 0x1c, 0xff}, color.RGBA{0xe4, 0xe8, 0xe0, 0xff}},
+	"hp48":  {color.RGBA{0x8a, 0x9a, 0x84, 0xff}, color.RGBA{0x22, 0x2a, 0x28, 0xff}},
+}
+
+var displayPalette = palettes["bw"]
+
+// paletteColor parses a color written as rrggbb or #rrggbb.
+func paletteColor(s string) (color.RGBA, error) {
+	rgb, err := hex.DecodeString(strings.TrimPrefix(s, "#"))
+	if err != nil || len(rgb) != 3 {
+		return color.RGBA{}, fmt.Errorf("invalid color %s, expected #rrggbb", s)
+	}
+	return color.RGBA{rgb[0], rgb[1], rgb[2], 0xff}, nil
+}
+
+func paletteFormatColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// paletteNames returns the names of the known palettes, sorted.
+func paletteNames() []string {
+	names := make([]string, 0, len(palettes))
+	for name := range palettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func paletteParse(name string) (palette, error) {
+	p, ok := palettes[strings.ToLower(name)]
+	if !ok {
+		return p, fmt.Errorf("unknown palette %s, known palettes are %s", name, strings.Join(paletteNames(), ", "))
+	}
+	return p, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+// ROM patches
+//
+// Fixes and translations of programs are distributed as IPS or BPS patches.
+// The patch given by -patch is applied to the program image when it is
+// loaded, before it is copied to memory. IPS patches are lists of bytes to
+// write at offsets of the image; BPS patches rebuild the image from the
+// original and carry the CRC-32 of the original, of the result and of the
+// patch itself, which are all checked.
+//
+// The image of the program as loaded, before any patch, is kept so that the
+// ips command can write the changes made to memory since, with poke for
+// instance, as an IPS patch.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// patchOriginal is the image of the program loaded, before any patch.
+var patchOriginal []byte
+
+// ipsCommand writes the differences between the program as loaded and
+// memory as an IPS patch. Memory is compared up to the end of the program or
+// to the last non-zero byte, whichever is further.
+func ipsCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing file name")
+	}
+	if patchOriginal == nil {
+		return errors.New("no program loaded")
+	}
+
+	end := MEMEND
+	for end > MEMPROGRAMSTART+len(patchOriginal) && m.memory[end-1] == 0 {
+		end--
+	}
+	target := m.memory[MEMPROGRAMSTART:end]
+
+	// bytes beyond the program are zeros, as patches grow it with zeros
+	original := func(offset int) byte {
+		if offset < len(patchOriginal) {
+			return patchOriginal[offset]
+		}
+		return 0
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	w.WriteString("PATCH")
+	changed := 0
+	for offset := 0; offset < len(target); {
+		if target[offset] == original(offset) {
+			offset++
+			continue
+		}
+		size := 0
+		for offset+size < len(target) && size < 0xffff && target[offset+size] != original(offset+size) {
+			size++
+		}
+		w.Write([]byte{byte(offset >> 16), byte(offset >> 8), byte(offset), byte(size >> 8), byte(size)})
+		w.Write(target[offset : offset+size])
+		changed += size
+		offset += size
+	}
+	w.WriteString("EOF")
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	fmt.Printf("Wrote %d changed bytes to %s\n", changed, args[0])
+	return file.Close()
+}
+
+// patchApply applies an IPS or BPS patch file to an image.
+func patchApply(image []byte, path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("PATCH")):
+		image, err = patchApplyIPS(image, data)
+	case bytes.HasPrefix(data, []byte("BPS1")):
+		image, err = patchApplyBPS(image, data)
+	default:
+		err = errors.New("not an IPS or BPS patch")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+	}
+	return image, nil
+}
+
+// patchApplyBPS rebuilds the image from the source read, source copy,
+// target read and target copy actions of a BPS patch.
+func patchApplyBPS(source []byte, data []byte) ([]byte, error) {
+	if len(data) < 4+12 {
+		return nil, errors.New("truncated patch")
+	}
+	footer := data[len(data)-12:]
+	if crc32.ChecksumIEEE(data[:len(data)-4]) != binary.LittleEndian.Uint32(footer[8:]) {
+		return nil, errors.New("patch checksum mismatch")
+	}
+	if crc32.ChecksumIEEE(source) != binary.LittleEndian.Uint32(footer) {
+		return nil, errors.New("the patch is not meant for this program")
+	}
+
+	actions := data[4 : len(data)-12]
+	number := func() (int, error) {
+		n, shift := 0, 1
+		for {
+			if len(actions) == 0 || shift > 1<<28 {
+				return 0, errors.New("truncated patch")
+			}
+			b := int(actions[0])
+			actions = actions[1:]
+			n += (b & 0x7f) * shift
+			if b&0x80 != 0 {
+				return n, nil
+			}
+			shift <<= 7
+			n += shift
+		}
+	}
+	offset := func(base int) (int, error) {
+		n, err := number()
+		if n&1 != 0 {
+			return base - n>>1, err
+		}
+		return base + n>>1, err
+	}
+
+	sourceSize, err := number()
+	if err != nil {
+		return nil, err
+	}
+	targetSize, err := number()
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := number()
+	if err != nil || metadata > len(actions) {
+		return nil, errors.New("truncated patch")
+	}
+	actions = actions[metadata:]
+	if sourceSize != len(source) {
+		return nil, errors.New("the patch is not meant for this program")
+	}
+	if targetSize > MEMEND {
+		return nil, fmt.Errorf("patched program too big: %d bytes", targetSize)
+	}
+
+	target := make([]byte, 0, targetSize)
+	sourceOffset, targetOffset := 0, 0
+	for len(actions) > 0 {
+		n, err := number()
+		if err != nil {
+			return nil, err
+		}
+		length := n>>2 + 1
+		if len(target)+length > targetSize {
+			return nil, errors.New("invalid patch")
+		}
+		switch n & 3 {
+		case 0: // source read
+			if len(target)+length > len(source) {
+				return nil, errors.New("invalid patch")
+			}
+			target = append(target, source[len(target):len(target)+length]...)
+		case 1: // target read
+			if length > len(actions) {
+				return nil, errors.New("truncated patch")
+			}
+			target = append(target, actions[:length]...)
+			actions = actions[length:]
+		case 2: // source copy
+			if sourceOffset, err = offset(sourceOffset); err != nil {
+				return nil, err
+			}
+			if sourceOffset < 0 || sourceOffset+length > len(source) {
+				return nil, errors.New("invalid patch")
+			}
+			target = append(target, source[sourceOffset:sourceOffset+length]...)
+			sourceOffset += length
+		case 3: // target copy, byte by byte as the copy can overlap
+			if targetOffset, err = offset(targetOffset); err != nil {
+				return nil, err
+			}
+			if targetOffset < 0 || targetOffset >= len(target) {
+				return nil, errors.New("invalid patch")
+			}
+			for i := 0; i < length; i++ {
+				target = append(target, target[targetOffset])
+				targetOffset++
+			}
+		}
+	}
+
+	if len(target) != targetSize || crc32.ChecksumIEEE(target) != binary.LittleEndian.Uint32(footer[4:]) {
+		return nil, errors.New("patched program checksum mismatch")
+	}
+	return target, nil
+}
+
+// patchApplyIPS writes the records of an IPS patch to the image, growing it
+// when they are beyond its end, then truncates it if the patch says so.
+func patchApplyIPS(image []byte, data []byte) ([]byte, error) {
+	image = append([]byte{}, image...)
+	data = data[5:]
+	for {
+		if len(data) < 3 {
+			return nil, errors.New("truncated patch")
+		}
+		if string(data[:3]) == "EOF" {
+			data = data[3:]
+			break
+		}
+		if len(data) < 5 {
+			return nil, errors.New("truncated patch")
+		}
+		offset := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+		size := int(binary.BigEndian.Uint16(data[3:]))
+		data = data[5:]
+
+		var record []byte
+		if size == 0 {
+			// run of a single byte
+			if len(data) < 3 {
+				return nil, errors.New("truncated patch")
+			}
+			record = bytes.Repeat(data[2:3], int(binary.BigEndian.Uint16(data)))
+			data = data[3:]
+		} else {
+			if len(data) < size {
+				return nil, errors.New("truncated patch")
+			}
+			record = data[:size]
+			data = data[size:]
+		}
+
+		if offset+len(record) > MEMEND {
+			return nil, fmt.Errorf("record at 0x%x out of memory", offset)
+		}
+		for len(image) < offset+len(record) {
+			image = append(image, 0)
+		}
+		copy(image[offset:], record)
+	}
+
+	// truncation extension
+	if len(data) >= 3 {
+		size := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+		if size < len(image) {
+			image = image[:size]
+		}
+	}
+	return image, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPatchApplyIPS(t *testing.T) {
+	source := []byte("abcdef")
+	tests := []struct {
+		name  string
+		patch string
+		image string
+		err   string
+	}{
+		{"record", "PATCH\x00\x00\x02\x00\x02XYEOF", "abXYef", ""},
+		{"records", "PATCH\x00\x00\x00\x00\x01A\x00\x00\x05\x00\x01FEOF", "AbcdeF", ""},
+		{"no records", "PATCHEOF", "abcdef", ""},
+		{"beyond the end", "PATCH\x00\x00\x08\x00\x01XEOF", "abcdef\x00\x00X", ""},
+		{"run", "PATCH\x00\x00\x01\x00\x00\x00\x03ZEOF", "aZZZef", ""},
+		{"run beyond the end", "PATCH\x00\x00\x05\x00\x00\x00\x02ZEOF", "abcdeZZ", ""},
+		{"truncation", "PATCH\x00\x00\x00\x00\x01AEOF\x00\x00\x03", "Abc", ""},
+		{"truncation beyond the end", "PATCHEOF\x00\x00\x10", "abcdef", ""},
+		{"missing end of file", "PATCH\x00\x00\x02\x00\x02XY", "", "truncated patch"},
+		{"truncated header", "PATCH\x00\x00\x02\x00", "", "truncated patch"},
+		{"truncated record", "PATCH\x00\x00\x02\x00\x04XYEOF", "", "truncated patch"},
+		{"truncated run", "PATCH\x00\x00\x02\x00\x00\x00", "", "truncated patch"},
+		{"record out of memory", "PATCH\x00\x0f\xff\x00\x02XYEOF", "", "record at 0xfff out of memory"},
+		{"run out of memory", "PATCH\x00\x0f\x00\x00\x00\x10\x00ZEOF", "", "record at 0xf00 out of memory"},
+	}
+	for _, test := range tests {
+		image, err := patchApplyIPS(source, []byte(test.patch))
+		patchTestCheck(t, test.name, image, err, test.image, test.err)
+	}
+	if string(source) != "abcdef" {
+		t.Errorf("the source was modified: %q", source)
+	}
+}
+
+func TestPatchApplyBPS(t *testing.T) {
+	source := []byte("abcdef")
+	// actions: source read, target read, source copy and target copy of
+	// length bytes, followed by their data or relative offset
+	action := func(kind int, length int) []byte {
+		return patchTestNumber((length-1)<<2 | kind)
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	offset := func(n int) []byte {
+		if n < 0 {
+			return patchTestNumber(-n<<1 | 1)
+		}
+		return patchTestNumber(n << 1)
+	}
+
+	// the checksums of the patch and of the result are both checked
+	corrupted := patchTestBPS(source, "abcd", action(0, 4))
+	corrupted[5] ^= 1
+	wrongTarget := patchTestBPS(source, "abcd", action(0, 4))
+	wrongTarget[len(wrongTarget)-8] ^= 1
+	binary.LittleEndian.PutUint32(wrongTarget[len(wrongTarget)-4:], crc32.ChecksumIEEE(wrongTarget[:len(wrongTarget)-4]))
+
+	tests := []struct {
+		name  string
+		patch []byte
+		image string
+		err   string
+	}{
+		{"source read", patchTestBPS(source, "abcd", action(0, 4)), "abcd", ""},
+		{"target read", patchTestBPS(source, "abXYef", join(action(0, 2), action(1, 2), []byte("XY"), action(0, 2))), "abXYef", ""},
+		{"source copy", patchTestBPS(source, "efab", join(action(2, 2), offset(4), action(2, 2), offset(-6))), "efab", ""},
+		{"target copy", patchTestBPS(source, "ababab", join(action(1, 2), []byte("ab"), action(3, 4), offset(0))), "ababab", ""},
+		{"longer", patchTestBPS(source, "abcdefgh", join(action(0, 6), action(1, 2), []byte("gh"))), "abcdefgh", ""},
+		{"truncated", []byte("BPS1\x86\x84\x80"), "", "truncated patch"},
+		{"truncated number", patchTestBPS(source, "abcdef", []byte{0x00}), "", "truncated patch"},
+		{"truncated target read", patchTestBPS(source, "abXYef", join(action(1, 6), []byte("abXY"))), "", "truncated patch"},
+		{"source read past the end", patchTestBPS(source, "abcdefgh", action(0, 8)), "", "invalid patch"},
+		{"source copy out of range", patchTestBPS(source, "ab", join(action(2, 2), offset(5))), "", "invalid patch"},
+		{"target copy out of range", patchTestBPS(source, "abab", join(action(1, 2), []byte("ab"), action(3, 2), offset(2))), "", "invalid patch"},
+		{"target too long", patchTestBPS(source, "ab", action(0, 4)), "", "invalid patch"},
+		{"target too short", patchTestBPS(source, "abcd", action(0, 2)), "", "patched program checksum mismatch"},
+		{"program too big", patchTestBPS(source, strings.Repeat("x", MEMEND+1), nil), "", "patched program too big"},
+		{"other program", patchTestBPS([]byte("abcdeg"), "abcd", action(0, 4)), "", "the patch is not meant for this program"},
+		{"patch checksum", corrupted, "", "patch checksum mismatch"},
+		{"target checksum", wrongTarget, "", "patched program checksum mismatch"},
+	}
+	for _, test := range tests {
+		image, err := patchApplyBPS(source, test.patch)
+		patchTestCheck(t, test.name, image, err, test.image, test.err)
+	}
+}
+
+func TestPatchApply(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	source := []byte("abcdef")
+
+	image, err := patchApply(source, write("fix.ips", []byte("PATCH\x00\x00\x02\x00\x02XYEOF")))
+	patchTestCheck(t, "ips", image, err, "abXYef", "")
+	image, err = patchApply(source, write("fix.bps", patchTestBPS(source, "abcd", patchTestNumber(3<<2))))
+	patchTestCheck(t, "bps", image, err, "abcd", "")
+	_, err = patchApply(source, write("fix.txt", []byte("not a patch")))
+	patchTestCheck(t, "unknown format", nil, err, "", "fix.txt: not an IPS or BPS patch")
+	_, err = patchApply(source, write("broken.ips", []byte("PATCH")))
+	patchTestCheck(t, "error", nil, err, "", "broken.ips: truncated patch")
+	_, err = patchApply(source, filepath.Join(dir, "missing.ips"))
+	if !os.IsNotExist(err) {
+		t.Errorf("missing patch: got error %v", err)
+	}
+}
+
+// patchTestBPS returns a BPS patch with the actions turning source into
+// target, and valid checksums.
+func patchTestBPS(source []byte, target string, actions []byte) []byte {
+	patch := []byte("BPS1")
+	patch = append(patch, patchTestNumber(len(source))...)
+	patch = append(patch, patchTestNumber(len(target))...)
+	patch = append(patch, patchTestNumber(0)...)
+	patch = append(patch, actions...)
+	patch = binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(source))
+	patch = binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE([]byte(target)))
+	return binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(patch))
+}
+
+// patchTestCheck compares the image or the error of a patch with the expected
+// ones.
+func patchTestCheck(t *testing.T, name string, image []byte, err error, expected string, expectedErr string) {
+	t.Helper()
+	if expectedErr != "" {
+		if err == nil || !strings.Contains(err.Error(), expectedErr) {
+			t.Errorf("%s: got error %v, expected %q", name, err, expectedErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if string(image) != expected {
+		t.Errorf("%s: got %q, expected %q", name, image, expected)
+	}
+}
+
+// patchTestNumber encodes a number of a BPS patch.
+func patchTestNumber(n int) []byte {
+	var data []byte
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			return append(data, b|0x80)
+		}
+		data = append(data, b)
+		n--
+	}
+}
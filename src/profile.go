@@ -0,0 +1,257 @@
+package main
+
+// Execution profiler
+//
+// When enabled, every executed instruction is counted per address and per
+// opcode. Subroutine costs are measured in executed instructions between a
+// call and the matching ret, including nested calls. For each 60Hz frame we
+// also record how many instructions were executed and whether one of them
+// was a DRW.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+type profileSubroutine struct {
+	calls        uint64
+	instructions uint64 // including the instructions of nested calls
+}
+
+// profileCall is an entry of the shadow call stack.
+type profileCall struct {
+	address      uint16
+	instructions uint64 // total instructions count when the call happened
+}
+
+type profileData struct {
+	enabled      bool
+	instructions uint64
+	addresses    [MEMEND]uint64
+	opcodes      [invalid + 1]uint64
+	subroutines  map[uint16]*profileSubroutine
+	calls        []profileCall
+
+	frames            uint64
+	drawFrames        uint64
+	frameSizes        map[int]uint64 // number of frames per instructions count
+	frameInstructions int
+	frameDrew         bool
+}
+
+var profile = profileData{
+	subroutines: make(map[uint16]*profileSubroutine),
+	frameSizes:  make(map[int]uint64),
+}
+
+func profileCommand(args []string) error {
+	if len(args) == 0 {
+		args = []string{"show"}
+	}
+
+	switch args[0] {
+	case "start":
+		profile.enabled = true
+
+	case "stop":
+		profile.enabled = false
+
+	case "reset":
+		profileReset()
+
+	case "show":
+		count := 10
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid count %s", args[1])
+			}
+			count = n
+		}
+		profileReport(os.Stdout, count, false)
+
+	case "report":
+		if len(args) < 2 {
+			return fmt.Errorf("missing file name")
+		}
+		file, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		profileReport(file, -1, true)
+		return file.Close()
+
+	default:
+		return fmt.Errorf("invalid profile command %s", args[0])
+	}
+	return nil
+}
+
+// profileFrame is called at the end of each 60Hz frame.
+func profileFrame() {
+	if !profile.enabled {
+		return
+	}
+
+	profile.frames++
+	if profile.frameDrew {
+		profile.drawFrames++
+	}
+	profile.frameSizes[profile.frameInstructions]++
+	profile.frameInstructions = 0
+	profile.frameDrew = false
+}
+
+// profileInstruction is called before executing the instruction at address.
+func profileInstruction(address uint16, instruction instruction) {
+	if !profile.enabled {
+		return
+	}
+
+	profile.instructions++
+	profile.addresses[address]++
+	profile.opcodes[instruction.op]++
+	profile.frameInstructions++
+
+	switch instruction.op {
+	case drw:
+		profile.frameDrew = true
+
+	case call:
+		profile.calls = append(profile.calls, profileCall{instruction.nnn, profile.instructions})
+
+	case ret:
+		// a ret without call happens when profiling started in a subroutine
+		if n := len(profile.calls); n > 0 {
+			c := profile.calls[n-1]
+			profile.calls = profile.calls[:n-1]
+
+			s, ok := profile.subroutines[c.address]
+			if !ok {
+				s = &profileSubroutine{}
+				profile.subroutines[c.address] = s
+			}
+			s.calls++
+			s.instructions += profile.instructions - c.instructions + 1
+		}
+	}
+}
+
+// profileReport writes the top count hot spots and subroutines (all of them
+// if count is negative), the opcodes histogram and the frames statistics,
+// followed by the annotated disassembly if requested.
+func profileReport(w io.Writer, count int, disassembly bool) {
+	percent := func(n uint64, total uint64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(total)
+	}
+	limit := func(n int) int {
+		if count >= 0 && count < n {
+			return count
+		}
+		return n
+	}
+
+	fmt.Fprintf(w, "%d instructions, %d frames, %d frames with DRW (%.1f%%)\n",
+		profile.instructions, profile.frames, profile.drawFrames, percent(profile.drawFrames, profile.frames))
+
+	fmt.Fprintf(w, "\nHot spots:\n")
+	hot := make([]uint16, 0)
+	for address, n := range profile.addresses {
+		if n > 0 {
+			hot = append(hot, uint16(address))
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		a, b := profile.addresses[hot[i]], profile.addresses[hot[j]]
+		return a > b || (a == b && hot[i] < hot[j])
+	})
+	for _, address := range hot[:limit(len(hot))] {
+		fmt.Fprintf(w, "%10d %5.1f%%  0x%03x: %s\n", profile.addresses[address],
+			percent(profile.addresses[address], profile.instructions), address, disasmInstruction(address))
+	}
+
+	fmt.Fprintf(w, "\nOpcodes:\n")
+	opcodes := make([]opcode, 0)
+	for op, n := range profile.opcodes {
+		if n > 0 {
+			opcodes = append(opcodes, opcode(op))
+		}
+	}
+	sort.Slice(opcodes, func(i, j int) bool {
+		a, b := profile.opcodes[opcodes[i]], profile.opcodes[opcodes[j]]
+		return a > b || (a == b && opcodes[i] < opcodes[j])
+	})
+	for _, op := range opcodes {
+		fmt.Fprintf(w, "%10d %5.1f%%  %s\n", profile.opcodes[op], percent(profile.opcodes[op], profile.instructions), opcodeDescriptions[op])
+	}
+
+	fmt.Fprintf(w, "\nSubroutines:\n")
+	subroutines := make([]uint16, 0, len(profile.subroutines))
+	for address := range profile.subroutines {
+		subroutines = append(subroutines, address)
+	}
+	sort.Slice(subroutines, func(i, j int) bool {
+		a, b := profile.subroutines[subroutines[i]].instructions, profile.subroutines[subroutines[j]].instructions
+		return a > b || (a == b && subroutines[i] < subroutines[j])
+	})
+	fmt.Fprintf(w, "%10s %10s %6s  %s\n", "calls", "instrs", "", "address")
+	for _, address := range subroutines[:limit(len(subroutines))] {
+		s := profile.subroutines[address]
+		name := fmt.Sprintf("0x%03x", address)
+		if label, ok := symbolsLabel(address); ok {
+			name += " " + label
+		}
+		fmt.Fprintf(w, "%10d %10d %5.1f%%  %s\n", s.calls, s.instructions, percent(s.instructions, profile.instructions), name)
+	}
+
+	fmt.Fprintf(w, "\nInstructions per frame:\n")
+	sizes := make([]int, 0, len(profile.frameSizes))
+	for size := range profile.frameSizes {
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	for _, size := range sizes {
+		fmt.Fprintf(w, "%10d %5.1f%%  %d instructions\n", profile.frameSizes[size], percent(profile.frameSizes[size], profile.frames), size)
+	}
+
+	if !disassembly || len(hot) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\nAnnotated disassembly:\n")
+	last := MEMPROGRAMSTART
+	for _, address := range hot {
+		if int(address) > last {
+			last = int(address)
+		}
+	}
+	for address := MEMPROGRAMSTART; address <= last; address += 2 {
+		// follow code running at odd addresses
+		if address+1 < MEMEND && profile.addresses[address] == 0 && profile.addresses[address+1] > 0 {
+			address++
+		}
+		hits := ""
+		if n := profile.addresses[address]; n > 0 {
+			hits = strconv.FormatUint(n, 10)
+		}
+		if label, ok := symbolsLabel(uint16(address)); ok {
+			fmt.Fprintf(w, "%10s  %s:\n", "", label)
+		}
+		fmt.Fprintf(w, "%10s  0x%03x: 0x%04x %s\n", hits, address, machineGetInstruction(uint16(address)), disasmInstruction(uint16(address)))
+	}
+}
+
+func profileReset() {
+	enabled := profile.enabled
+	profile = profileData{
+		enabled:     enabled,
+		subroutines: make(map[uint16]*profileSubroutine),
+		frameSizes:  make(map[int]uint64),
+	}
+}
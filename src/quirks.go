@@ -0,0 +1,134 @@
+package main
+
+// Compatibility settings
+//
+// CHIP-8 interpreters differ in a few instructions, and programs written for
+// one of them may not work with another. Quirks select the behavior of those
+// instructions, the defaults being the ones this interpreter always had:
+//
+//	vfreset   8xy1, 8xy2 and 8xy3 reset VF (COSMAC VIP)
+//	memory    Fx55 and Fx65 increment I (COSMAC VIP)
+//	shift     8xy6 and 8xyE shift Vx in place instead of copying Vy (on)
+//	jumping   Bxnn jumps to xnn + Vx instead of nnn + V0 (SUPER-CHIP)
+//	clipping  DRW clips sprites at the edges instead of wrapping them (on)
+//
+// The speed of programs also depends on the number of instructions executed
+// per 60Hz frame, 9 by default (540Hz).
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULTIPF = 9
+	MAXIPF     = 1000
+)
+
+type quirks struct {
+	vfReset  bool
+	memory   bool
+	shift    bool
+	jumping  bool
+	clipping bool
+}
+
+var defaultQuirks = quirks{shift: true, clipping: true}
+
+// quirkFlags returns the flags of the quirks by name.
+func quirkFlags(q *quirks) map[string]*bool {
+	return map[string]*bool{
+		"vfreset":  &q.vfReset,
+		"memory":   &q.memory,
+		"shift":    &q.shift,
+		"jumping":  &q.jumping,
+		"clipping": &q.clipping,
+	}
+}
+
+// quirkNames returns the names of the quirks, sorted.
+func quirkNames() []string {
+	names := []string{}
+	for name := range quirkFlags(&m.quirks) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// quirksCommand shows the quirks, or sets them: quirks <name> on|off, or
+// quirks default.
+func quirksCommand(args []string) error {
+	if len(args) == 0 {
+		flags := quirkFlags(&m.quirks)
+		for _, name := range quirkNames() {
+			fmt.Printf("%-8s %t\n", name, *flags[name])
+		}
+		return nil
+	}
+
+	if args[0] == "default" {
+		m.quirks = defaultQuirks
+		return nil
+	}
+	if len(args) < 2 || (args[1] != "on" && args[1] != "off") {
+		return fmt.Errorf("missing on or off")
+	}
+	return quirksSet(&m.quirks, args[0], args[1] == "on")
+}
+
+// quirksEnabled returns the names of the quirks that are on.
+func quirksEnabled(q quirks) []string {
+	flags := quirkFlags(&q)
+	names := []string{}
+	for _, name := range quirkNames() {
+		if *flags[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// quirksParse parses a comma separated list of the quirks that are on, the
+// others being off.
+func quirksParse(list string) (quirks, error) {
+	var q quirks
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if err := quirksSet(&q, name, true); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+func quirksSet(q *quirks, name string, on bool) error {
+	flag, ok := quirkFlags(q)[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown quirk %s, known quirks are %s", name, strings.Join(quirkNames(), ", "))
+	}
+	*flag = on
+	return nil
+}
+
+// ipfCommand shows or sets the number of instructions per frame.
+func ipfCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("%d instructions per frame (%dHz)\n", m.ipf, m.ipf*60)
+		return nil
+	}
+	return ipfSet(args[0])
+}
+
+func ipfSet(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > MAXIPF {
+		return fmt.Errorf("invalid number of instructions per frame %s, expected 1 to %d", value, MAXIPF)
+	}
+	m.ipf = n
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+// ROM database
+//
+// Programs are identified by the SHA-1 hash of their image. The database
+// gives their title, author, platform and description, and the settings
+// they need: quirks, instructions per frame, key mapping, colors and display
+// filter, which are applied when the program is loaded. The rc and keymap
+// files of the program run afterwards and can override them.
+//
+// The database bundled with the interpreter (romdb.json) is completed by the
+// entries of ~/.chip8db.json, which replace the bundled ones for the same
+// hash. Both are JSON objects of entries keyed by hash:
+//
+//	{
+//	  "56812e23757551259ceedff3491bb72e2f7f0783": {
+//	    "title": "Pong",
+//	    "quirks": ["shift", "clipping"],
+//	    "ipf": 9,
+//	    "keymap": {"up": "1"},
+//	    "palette": "green",
+//	    "filter": "blend 3,hold on"
+//	  }
+//	}
+
+import (
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ROMDBFILE = ".chip8db.json"
+)
+
+//go:embed romdb.json
+var romdbBundled []byte
+
+type romdbEntry struct {
+	Title       string            `json:"title"`
+	Author      string            `json:"author,omitempty"`
+	Platform    string            `json:"platform,omitempty"`
+	Quirks      *[]string         `json:"quirks,omitempty"` // quirks on, nil for the default ones
+	IPF         int               `json:"ipf,omitempty"`
+	Keymap      map[string]string `json:"keymap,omitempty"` // key name to keypad key
+	Palette     string            `json:"palette,omitempty"`
+	Foreground  string            `json:"foreground,omitempty"`
+	Background  string            `json:"background,omitempty"`
+	Filter      string            `json:"filter,omitempty"` // filter commands separated by commas
+	Description string            `json:"description,omitempty"`
+}
+
+// romdbProgram is the hash of the program loaded and its entry, nil if the
+// program is not in the database.
+var romdbProgram struct {
+	hash  string
+	entry *romdbEntry
+}
+
+// romdbApply applies the settings of an entry to the machine, the keymap
+// and the display.
+func romdbApply(entry *romdbEntry) error {
+	if entry.Quirks != nil {
+		q, err := quirksParse(strings.Join(*entry.Quirks, ","))
+		if err != nil {
+			return err
+		}
+		m.quirks = q
+	}
+	if entry.IPF != 0 {
+		if err := ipfSet(strconv.Itoa(entry.IPF)); err != nil {
+			return err
+		}
+	}
+	if entry.Filter != "" {
+		f, err := filterParse(entry.Filter)
+		if err != nil {
+			return err
+		}
+		filter = f
+		filterReset()
+	}
+	for key, k := range entry.Keymap {
+		if err := keymapCommand([]string{"key", key, k}); err != nil {
+			return err
+		}
+	}
+	settings := [][2]string{{"palette", entry.Palette}, {"fg", entry.Foreground}, {"bg", entry.Background}}
+	for _, setting := range settings {
+		if setting[1] == "" {
+			continue
+		}
+		if err := displaySet(setting[0], setting[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// romdbEntries returns the bundled entries completed by the user ones.
+func romdbEntries() (map[string]*romdbEntry, error) {
+	entries := make(map[string]*romdbEntry)
+	if err := json.Unmarshal(romdbBundled, &entries); err != nil {
+		return nil, fmt.Errorf("romdb.json: %v", err)
+	}
+
+	user, err := romdbUserEntries()
+	if err != nil {
+		return nil, err
+	}
+	for hash, entry := range user {
+		entries[hash] = entry
+	}
+	return entries, nil
+}
+
+// romdbIdentify looks the program up in the database and applies the
+// settings of its entry. It is called by machineLoadProgram.
+func romdbIdentify(data []byte) error {
+	sum := sha1.Sum(data)
+	romdbProgram.hash = hex.EncodeToString(sum[:])
+	romdbProgram.entry = nil
+
+	entries, err := romdbEntries()
+	if err != nil {
+		return err
+	}
+	entry, ok := entries[romdbProgram.hash]
+	if !ok {
+		return nil
+	}
+	romdbProgram.entry = entry
+	if err := romdbApply(entry); err != nil {
+		return fmt.Errorf("%s: %v", entry.Title, err)
+	}
+	return nil
+}
+
+// romdbSave adds or replaces the entry of the program in the user database.
+func romdbSave(hash string, entry *romdbEntry) error {
+	path, err := romdbUserPath()
+	if err != nil {
+		return err
+	}
+	entries, err := romdbUserEntries()
+	if err != nil {
+		return err
+	}
+	entries[hash] = entry
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// romdbUserEntries returns the entries of ~/.chip8db.json, if it exists.
+func romdbUserEntries() (map[string]*romdbEntry, error) {
+	entries := make(map[string]*romdbEntry)
+	path, err := romdbUserPath()
+	if err != nil {
+		return entries, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return entries, nil
+}
+
+func romdbUserPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ROMDBFILE), nil
+}
+
+// infoCommand shows the entry of the program, or updates it in the user
+// database: info set <field> <value>, info key <name> <hex>|none, or info
+// save to record the current quirks, speed and colors.
+func infoCommand(args []string) error {
+	if romdbProgram.hash == "" {
+		return errors.New("no program loaded")
+	}
+
+	if len(args) == 0 {
+		fmt.Printf("SHA-1       %s\n", romdbProgram.hash)
+		e := romdbProgram.entry
+		if e == nil {
+			fmt.Println("not in the database")
+			return nil
+		}
+		fields := [][2]string{
+			{"title", e.Title}, {"author", e.Author}, {"platform", e.Platform},
+			{"ipf", ""}, {"palette", e.Palette}, {"foreground", e.Foreground},
+			{"background", e.Background}, {"filter", e.Filter}, {"description", e.Description},
+		}
+		if e.IPF != 0 {
+			fields[3][1] = strconv.Itoa(e.IPF)
+		}
+		if e.Quirks != nil {
+			fields = append(fields, [2]string{"quirks", strings.Join(*e.Quirks, ", ")})
+		}
+		keys := make([]string, 0, len(e.Keymap))
+		for key := range e.Keymap {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for n, key := range keys {
+			keys[n] = key + "=" + e.Keymap[key]
+		}
+		fields = append(fields, [2]string{"keymap", strings.Join(keys, " ")})
+		for _, field := range fields {
+			if field[1] != "" {
+				fmt.Printf("%-11s %s\n", field[0], field[1])
+			}
+		}
+		return nil
+	}
+
+	// start from a copy of the current entry
+	entry := &romdbEntry{Keymap: make(map[string]string)}
+	if romdbProgram.entry != nil {
+		copied := *romdbProgram.entry
+		entry = &copied
+		entry.Keymap = make(map[string]string)
+		for key, k := range romdbProgram.entry.Keymap {
+			entry.Keymap[key] = k
+		}
+	}
+
+	switch args[0] {
+	case "set":
+		if len(args) < 3 {
+			return errors.New("missing field or value")
+		}
+		value := strings.Join(args[2:], " ")
+		switch args[1] {
+		case "title":
+			entry.Title = value
+		case "author":
+			entry.Author = value
+		case "platform":
+			entry.Platform = value
+		case "description":
+			entry.Description = value
+		case "palette":
+			if _, err := paletteParse(value); err != nil {
+				return err
+			}
+			entry.Palette = value
+		case "foreground", "background":
+			if _, err := paletteColor(value); err != nil {
+				return err
+			}
+			if args[1] == "foreground" {
+				entry.Foreground = value
+			} else {
+				entry.Background = value
+			}
+		case "filter":
+			if _, err := filterParse(value); err != nil {
+				return err
+			}
+			entry.Filter = value
+		case "ipf":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > MAXIPF {
+				return fmt.Errorf("invalid number of instructions per frame %s", value)
+			}
+			entry.IPF = n
+		case "quirks":
+			q, err := quirksParse(value)
+			if err != nil {
+				return err
+			}
+			enabled := quirksEnabled(q)
+			entry.Quirks = &enabled
+		default:
+			return fmt.Errorf("unknown field %s", args[1])
+		}
+
+	case "key":
+		if len(args) < 3 {
+			return errors.New("missing key name or keypad key")
+		}
+		if args[2] == "none" {
+			delete(entry.Keymap, keymapName(args[1]))
+		} else {
+			if _, err := strconv.ParseUint(args[2], 16, 4); err != nil {
+				return fmt.Errorf("invalid keypad key %s", args[2])
+			}
+			entry.Keymap[keymapName(args[1])] = args[2]
+		}
+
+	case "save":
+		enabled := quirksEnabled(m.quirks)
+		entry.Quirks = &enabled
+		entry.IPF = m.ipf
+		entry.Palette = ""
+		entry.Foreground = paletteFormatColor(displayPalette.foreground)
+		entry.Background = paletteFormatColor(displayPalette.background)
+		entry.Filter = ""
+		if filterActive() {
+			entry.Filter = filterString(filter)
+		}
+
+	default:
+		return fmt.Errorf("invalid info command %s", args[0])
+	}
+
+	if err := romdbSave(romdbProgram.hash, entry); err != nil {
+		return err
+	}
+	romdbProgram.entry = entry
+	return nil
+}
@@ -0,0 +1,372 @@
+package main
+
+// JSON-RPC 2.0 control API, see https://www.jsonrpc.org/specification
+//
+// Requests, responses and notifications are JSON objects separated by new
+// lines. The server listens on a Unix socket ("unix:/path/to/socket") or on
+// a TCP address ("localhost:8000") and runs alongside the CLI.
+//
+// Methods and their params:
+//   - loadRom {"path"} or {"data"}: load a ROM from a file or from its image
+//     encoded in base64, and reset the machine, as the load command of the
+//     CLI does
+//   - reset, run, stop, step
+//   - getRegisters: returns {"v", "i", "pc", "sp", "dt", "st"}
+//   - setRegister {"name", "value"}: name as understood by the CLI (v0, i...)
+//   - readMemory {"address", "length"}: returns {"data"} encoded in base64
+//   - writeMemory {"address", "data"}: data encoded in base64
+//   - setBreakpoint {"address"}, deleteBreakpoint {"address"},
+//     clearBreakpoints, listBreakpoints
+//   - pressKey {"key"}, releaseKey {"key"}: key from 0 to 15
+//   - getFramebuffer: returns {"width", "height", "data"}, data being the
+//     pixmap encoded in base64, one bit per pixel, 8 pixels per byte with
+//     the most significant bit on the left, row after row
+//
+// Notifications sent to every client:
+//   - breakpoint {"address"}: a run reached a breakpoint, whether it was
+//     started with the run method, from the CLI or by a debugger
+//   - frame: the display changed
+//   - sound {"on"}: the buzzer was switched on or off
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	RPCPARSEERROR     = -32700
+	RPCMETHODNOTFOUND = -32601
+	RPCINVALIDPARAMS  = -32602
+	RPCSERVERERROR    = -32000
+)
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+type rpcMessage struct {
+	Version string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *rpcError        `json:"error,omitempty"`
+}
+
+// rpcClient serializes the messages written to a connection, replies and
+// notifications being sent from different goroutines.
+type rpcClient struct {
+	conn net.Conn
+	lock sync.Mutex
+}
+
+var rpcClients = struct {
+	sync.Mutex
+	set map[*rpcClient]bool
+}{set: make(map[*rpcClient]bool)}
+
+// rpcCall executes a method on the emulation goroutine and returns its
+// result.
+func rpcCall(method string, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Path    string  `json:"path"`
+		Name    string  `json:"name"`
+		Value   *uint16 `json:"value"`
+		Address *uint16 `json:"address"`
+		Length  int     `json:"length"`
+		Data    string  `json:"data"`
+		Key     *byte   `json:"key"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, &rpcError{RPCINVALIDPARAMS, err.Error()}
+		}
+	}
+	missing := func(name string) error {
+		return &rpcError{RPCINVALIDPARAMS, "missing " + name}
+	}
+
+	switch method {
+	case "loadRom":
+		if args.Path == "" && args.Data == "" {
+			return nil, missing("path or data")
+		}
+		if args.Path != "" {
+			if err := cliLoad(args.Path, false); err != nil {
+				return nil, err
+			}
+		} else {
+			data, err := base64.StdEncoding.DecodeString(args.Data)
+			if err != nil {
+				return nil, &rpcError{RPCINVALIDPARAMS, "invalid data"}
+			}
+			load := func() error {
+				return machineLoadProgramBytes(data)
+			}
+			if err := cliLoadFrom("", false, load); err != nil {
+				return nil, err
+			}
+		}
+
+	case "reset":
+		machineReset()
+
+	case "run":
+		if m.running {
+			return nil, fmt.Errorf("machine is already running")
+		}
+		machineRun()
+
+	case "stop":
+		machineStop()
+
+	case "step":
+		if m.running {
+			return nil, fmt.Errorf("machine is running, cannot step it")
+		}
+		machineStep()
+		return rpcRegisters(), nil
+
+	case "getRegisters":
+		return rpcRegisters(), nil
+
+	case "setRegister":
+		if args.Value == nil {
+			return nil, missing("value")
+		}
+		if err := machineSetRegister(args.Name, *args.Value); err != nil {
+			return nil, &rpcError{RPCINVALIDPARAMS, err.Error()}
+		}
+
+	case "readMemory":
+		if args.Address == nil {
+			return nil, missing("address")
+		}
+		end := int(*args.Address) + args.Length
+		if args.Length < 0 || end > MEMEND {
+			return nil, &rpcError{RPCINVALIDPARAMS, "invalid range"}
+		}
+		return map[string]string{"data": base64.StdEncoding.EncodeToString(m.memory[*args.Address:end])}, nil
+
+	case "writeMemory":
+		if args.Address == nil {
+			return nil, missing("address")
+		}
+		data, err := base64.StdEncoding.DecodeString(args.Data)
+		if err != nil || int(*args.Address)+len(data) > MEMEND {
+			return nil, &rpcError{RPCINVALIDPARAMS, "invalid data"}
+		}
+		copy(m.memory[*args.Address:], data)
+
+	case "setBreakpoint":
+		if args.Address == nil || *args.Address >= MEMEND {
+			return nil, missing("address")
+		}
+		machineAddBreakpoint(*args.Address)
+
+	case "deleteBreakpoint":
+		if args.Address == nil {
+			return nil, missing("address")
+		}
+		machineDeleteBreakpointAt(*args.Address)
+
+	case "clearBreakpoints":
+		machineClearBreakpoints()
+
+	case "listBreakpoints":
+		return append([]uint16{}, machineListBreakpoints()...), nil
+
+	case "pressKey", "releaseKey":
+		if args.Key == nil || *args.Key > 0xf {
+			return nil, missing("key")
+		}
+		machineUpdateKeyboard(*args.Key, method == "pressKey")
+
+	case "getFramebuffer":
+		data := make([]byte, SCREENWIDTH*SCREENHEIGHT/8)
+		for y := 0; y < SCREENHEIGHT; y++ {
+			for x := 0; x < SCREENWIDTH; x++ {
+				if m.pixmap[x][y] != 0 {
+					data[(y*SCREENWIDTH+x)/8] |= 0x80 >> (x % 8)
+				}
+			}
+		}
+		return map[string]interface{}{
+			"width":  SCREENWIDTH,
+			"height": SCREENHEIGHT,
+			"data":   base64.StdEncoding.EncodeToString(data),
+		}, nil
+
+	default:
+		return nil, &rpcError{RPCMETHODNOTFOUND, "method not found: " + method}
+	}
+	return "OK", nil
+}
+
+// rpcForward passes the display and buzzer ticks on to the frontend and
+// turns them into frame and sound notifications.
+func rpcForward(ctx context.Context, buzz chan struct{}, draw chan struct{}, ioBuzz chan struct{}, ioDraw chan struct{}) {
+	forward := func(c chan struct{}) {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+
+	latest := machineSnapshotLatest()
+	sound, version, breaks := latest.sounding, latest.version, latest.breaks
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-buzz:
+			latest := machineSnapshotLatest()
+			if latest.sounding != sound {
+				sound = latest.sounding
+				rpcNotify("sound", map[string]bool{"on": sound})
+			}
+			if latest.breaks != breaks {
+				breaks = latest.breaks
+				rpcNotify("breakpoint", map[string]uint16{"address": latest.breakpoint})
+			}
+			forward(ioBuzz)
+
+		case <-draw:
+			if v := machineSnapshotLatest().version; v != version {
+				version = v
+				rpcNotify("frame", nil)
+			}
+			forward(ioDraw)
+		}
+	}
+}
+
+func rpcNotify(method string, params interface{}) {
+	message := rpcMessage{Version: "2.0", Method: method}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return
+		}
+		message.Params = data
+	}
+
+	rpcClients.Lock()
+	defer rpcClients.Unlock()
+	for client := range rpcClients.set {
+		rpcSend(client, message)
+	}
+}
+
+func rpcRegisters() interface{} {
+	// converted as []byte would be encoded in base64
+	v := make([]int, len(m.regs.v))
+	for x := range v {
+		v[x] = int(m.regs.v[x])
+	}
+	return map[string]interface{}{
+		"v":  v,
+		"i":  m.regs.i,
+		"pc": m.regs.pc,
+		"sp": m.regs.sp,
+		"dt": m.regs.dt,
+		"st": m.regs.st,
+	}
+}
+
+func rpcSend(client *rpcClient, message rpcMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("rpc: %v\n", err)
+		return
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.conn.Write(append(data, '\n'))
+}
+
+// rpcServe listens for clients on address, either "unix:/path" or a TCP
+// address, and serves them concurrently. It only returns if it cannot
+// listen.
+func rpcServe(address string) error {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+		os.Remove(address)
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go rpcSession(&rpcClient{conn: conn})
+	}
+}
+
+func rpcSession(client *rpcClient) {
+	rpcClients.Lock()
+	rpcClients.set[client] = true
+	rpcClients.Unlock()
+
+	defer func() {
+		rpcClients.Lock()
+		delete(rpcClients.set, client)
+		rpcClients.Unlock()
+		client.conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(client.conn)
+	for scanner.Scan() {
+		var request rpcMessage
+		reply := rpcMessage{Version: "2.0"}
+
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			reply.Error = &rpcError{RPCPARSEERROR, err.Error()}
+			rpcSend(client, reply)
+			continue
+		}
+
+		var result interface{}
+		var err error
+		machineDo(func() {
+			result, err = rpcCall(request.Method, request.Params)
+		})
+		// requests without id are notifications and get no reply
+		if request.ID == nil {
+			continue
+		}
+		reply.ID = request.ID
+		if err != nil {
+			if e, ok := err.(*rpcError); ok {
+				reply.Error = e
+			} else {
+				reply.Error = &rpcError{RPCSERVERERROR, err.Error()}
+			}
+		} else {
+			reply.Result = result
+		}
+		rpcSend(client, reply)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+// Sprite viewer and extractor
+//
+// Sprites are 8 pixels wide and 1 to 15 pixels high, one byte per row with
+// the most significant bit on the left. Every sprite drawn by DRW is logged
+// with the number of times it was drawn, so that the graphics of a program
+// can be listed and exported as a sprite sheet.
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	SPRITESHEETCOLUMNS = 16
+	SPRITEWIDTH        = 8
+	SPRITEMAXHEIGHT    = 15
+	SPRITEFONTHEIGHT   = 5
+)
+
+type spriteKey struct {
+	address uint16
+	height  byte
+}
+
+// spriteLog counts the draws of each sprite.
+var spriteLog = make(map[spriteKey]uint64)
+
+func spriteCommand(args []string) error {
+	address := m.regs.i
+	height := -1
+	blocks := false
+
+	if len(args) > 0 && args[0] == "font" {
+		if len(args) < 2 {
+			return errors.New("missing digit")
+		}
+		digit, err := strconv.ParseUint(args[1], 16, 4)
+		if err != nil {
+			return fmt.Errorf("invalid digit %s", args[1])
+		}
+		address = MEMFONTS + uint16(digit)*SPRITEFONTHEIGHT
+		height = SPRITEFONTHEIGHT
+		args = args[2:]
+	}
+
+	for _, arg := range args {
+		switch {
+		case arg == "blocks":
+			blocks = true
+		case arg == "ascii":
+			blocks = false
+		case strings.HasPrefix(arg, "0x") || strings.HasPrefix(arg, "0X"):
+			n, err := cliParseNumber(arg)
+			if err != nil || n >= MEMEND {
+				return fmt.Errorf("invalid address %s", arg)
+			}
+			address = n
+		default:
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > SPRITEMAXHEIGHT {
+				return fmt.Errorf("invalid height %s", arg)
+			}
+			height = n
+		}
+	}
+
+	if height < 0 {
+		height = spriteHeight(address)
+	}
+	fmt.Printf("Sprite at 0x%03x, %d rows\n", address, height)
+	for _, line := range spriteRender(address, height, blocks) {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// spriteHeight guesses the height of the sprite at address from the log,
+// defaulting to the height of the font sprites.
+func spriteHeight(address uint16) int {
+	height := 0
+	var draws uint64
+	for key, count := range spriteLog {
+		if key.address == address && count > draws {
+			height, draws = int(key.height), count
+		}
+	}
+	if height == 0 {
+		return SPRITEFONTHEIGHT
+	}
+	return height
+}
+
+// spriteRecord is called by DRW.
+func spriteRecord(address uint16, height byte) {
+	spriteLog[spriteKey{address, height}]++
+}
+
+// spriteRender returns the sprite rows as # and . characters, or using
+// Unicode half blocks, two rows per line.
+func spriteRender(address uint16, height int, blocks bool) []string {
+	pixel := func(row int, column int) bool {
+		a := int(address) + row
+		return row < height && a < MEMEND && m.memory[a]&(0x80>>column) != 0
+	}
+
+	lines := make([]string, 0, height)
+	step := 1
+	if blocks {
+		step = 2
+	}
+	for row := 0; row < height; row += step {
+		var line strings.Builder
+		for column := 0; column < SPRITEWIDTH; column++ {
+			switch {
+			case !blocks && pixel(row, column):
+				line.WriteString("#")
+			case !blocks:
+				line.WriteString(".")
+			case pixel(row, column) && pixel(row+1, column):
+				line.WriteString("█")
+			case pixel(row, column):
+				line.WriteString("▀")
+			case pixel(row+1, column):
+				line.WriteString("▄")
+			default:
+				line.WriteString(" ")
+			}
+		}
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// spriteSheet writes the logged sprites to a PNG file, in the order of their
+// addresses, SPRITESHEETCOLUMNS per row, each pixel being scale pixels wide.
+func spriteSheet(path string, scale int) error {
+	keys := spriteSortedKeys()
+	if len(keys) == 0 {
+		return errors.New("no sprite was drawn")
+	}
+
+	// one pixel of padding around each sprite
+	cellWidth, cellHeight := (SPRITEWIDTH+1)*scale, (SPRITEMAXHEIGHT+1)*scale
+	rows := (len(keys) + SPRITESHEETCOLUMNS - 1) / SPRITESHEETCOLUMNS
+	columns := SPRITESHEETCOLUMNS
+	if len(keys) < columns {
+		columns = len(keys)
+	}
+	img := image.NewGray(image.Rect(0, 0, columns*cellWidth+scale, rows*cellHeight+scale))
+
+	for n, key := range keys {
+		x0 := (n%SPRITESHEETCOLUMNS)*cellWidth + scale
+		y0 := (n/SPRITESHEETCOLUMNS)*cellHeight + scale
+		for row := 0; row < int(key.height) && int(key.address)+row < MEMEND; row++ {
+			for column := 0; column < SPRITEWIDTH; column++ {
+				if m.memory[int(key.address)+row]&(0x80>>column) == 0 {
+					continue
+				}
+				for y := 0; y < scale; y++ {
+					for x := 0; x < scale; x++ {
+						img.SetGray(x0+column*scale+x, y0+row*scale+y, color.Gray{0xff})
+					}
+				}
+			}
+		}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func spriteSortedKeys() []spriteKey {
+	keys := make([]spriteKey, 0, len(spriteLog))
+	for key := range spriteLog {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].address != keys[j].address {
+			return keys[i].address < keys[j].address
+		}
+		return keys[i].height < keys[j].height
+	})
+	return keys
+}
+
+func spritesCommand(args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	switch args[0] {
+	case "list":
+		for _, key := range spriteSortedKeys() {
+			name := ""
+			if label, ok := symbolsLabel(key.address); ok {
+				name = " " + label
+			}
+			if key.address < MEMFONTS+uint16(len(fonts)) {
+				name = fmt.Sprintf(" font %X", (key.address-MEMFONTS)/SPRITEFONTHEIGHT)
+			}
+			fmt.Printf("0x%03x %2d rows %8d draws%s\n", key.address, key.height, spriteLog[key], name)
+		}
+
+	case "reset":
+		spriteLog = make(map[spriteKey]uint64)
+
+	case "png":
+		if len(args) < 2 {
+			return errors.New("missing file name")
+		}
+		scale := 4
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid scale %s", args[2])
+			}
+			scale = n
+		}
+		return spriteSheet(args[1], scale)
+
+	default:
+		return fmt.Errorf("invalid sprites command %s", args[0])
+	}
+	return nil
+}
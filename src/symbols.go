@@ -0,0 +1,159 @@
+package main
+
+// Symbol files give names to addresses and map source lines to addresses.
+//
+// Three kinds of lines are understood:
+//   - annotated listing lines such as the ones in games/pong.txt
+//     "0x22a: 0xa2ea LD I, 0x2ea ; LOOP: erase racket sprites"
+//     the line is mapped to the address and a comment starting with an
+//     upper case name followed by a colon defines a label;
+//   - label definitions "NAME = 0x2d4";
+//   - register notes "; V6 - ball x coordinate".
+//
+// Anything else, blank lines and comments (starting with ;) is ignored.
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type symbolTable struct {
+	source    string            // absolute path of the symbol file
+	labels    map[string]uint16 // label name to address
+	lines     map[int]uint16    // symbol file line to address
+	addresses map[uint16]int    // address to symbol file line
+	registers map[byte]string   // notes on the use of V registers
+}
+
+var symbols symbolTable
+
+var (
+	symbolsListingLine  = regexp.MustCompile(`^\s*0x([0-9a-fA-F]{1,3})\s*:\s*(?:0x)?[0-9a-fA-F]{4}\b[^;]*(?:;\s*(.*))?$`)
+	symbolsCommentLabel = regexp.MustCompile(`^([A-Z][A-Z0-9_ ]*):`)
+	symbolsDefinition   = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(\S+)\s*$`)
+	symbolsRegisterNote = regexp.MustCompile(`^\s*;\s*[Vv]([0-9A-Fa-f])\s+-\s*(\S.*)$`)
+)
+
+// symbolsAddress returns the address of the instruction at or after a
+// symbol file line, and the line it was found on.
+func symbolsAddress(line int) (uint16, int, bool) {
+	found := 0
+	for l := range symbols.lines {
+		if l >= line && (found == 0 || l < found) {
+			found = l
+		}
+	}
+	if found == 0 {
+		return 0, 0, false
+	}
+	return symbols.lines[found], found, true
+}
+
+// symbolsClear forgets all the symbols.
+func symbolsClear() {
+	symbols = symbolTable{
+		labels:    make(map[string]uint16),
+		lines:     make(map[int]uint16),
+		addresses: make(map[uint16]int),
+		registers: make(map[byte]string),
+	}
+}
+
+// symbolsLabel returns the label defined at address, if any.
+func symbolsLabel(address uint16) (string, bool) {
+	// iterate in a deterministic order as several labels can share an address
+	names := make([]string, 0, len(symbols.labels))
+	for name := range symbols.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if symbols.labels[name] == address {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// symbolsLine returns the symbol file line of the instruction at address.
+func symbolsLine(address uint16) (int, bool) {
+	line, ok := symbols.addresses[address]
+	return line, ok
+}
+
+// symbolsLoad replaces the current symbols with the ones of a symbol file.
+func symbolsLoad(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	source, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	return symbolsRead(file, source)
+}
+
+// symbolsNearest returns the closest label defined at or before address.
+func symbolsNearest(address uint16) (string, uint16, bool) {
+	var name string
+	var best uint16
+	found := false
+	for n, a := range symbols.labels {
+		if a <= address && (!found || a > best || (a == best && n < name)) {
+			name, best, found = n, a, true
+		}
+	}
+	return name, best, found
+}
+
+// symbolsRead replaces the current symbols with the ones read from r,
+// source being the path of the symbol file, if any.
+func symbolsRead(r io.Reader, source string) error {
+	symbolsClear()
+	symbols.source = source
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+
+		if match := symbolsListingLine.FindStringSubmatch(text); match != nil {
+			address, _ := strconv.ParseUint(match[1], 16, 16)
+			symbols.lines[line] = uint16(address)
+			symbols.addresses[uint16(address)] = line
+			if label := symbolsCommentLabel.FindStringSubmatch(match[2]); label != nil {
+				name := strings.ReplaceAll(strings.TrimSpace(label[1]), " ", "_")
+				symbols.labels[name] = uint16(address)
+			}
+			continue
+		}
+
+		if match := symbolsDefinition.FindStringSubmatch(text); match != nil {
+			if address, err := cliParseNumber(match[2]); err == nil {
+				symbols.labels[match[1]] = address
+			}
+			continue
+		}
+
+		if match := symbolsRegisterNote.FindStringSubmatch(text); match != nil {
+			x, _ := strconv.ParseUint(match[1], 16, 4)
+			symbols.registers[byte(x)] = strings.TrimSpace(match[2])
+		}
+	}
+	return scanner.Err()
+}
+
+// symbolsRegister returns the note on the use of a V register, if any.
+func symbolsRegister(x byte) (string, bool) {
+	note, ok := symbols.registers[x]
+	return note, ok
+}
@@ -0,0 +1,282 @@
+package main
+
+// Terminal frontend
+//
+// The display is drawn at the top of the terminal with Unicode half blocks
+// (64x16 characters) or braille patterns (32x8 characters) and ANSI colors,
+// only the cells that changed being redrawn. The debugger prompt runs below,
+// in a scrolling region.
+//
+// The terminal is put in non canonical mode without echo, so that keys are
+// read as soon as they are typed. Tab switches the keyboard between the game
+// and the prompt. As terminals do not report key releases, a keypad key is
+// released when it was not received for a while (terminals repeat held
+// keys). The characters typed are mapped to the keypad by keymap.go.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	TERMFOCUSKEY = '\t'
+	TERMBELL     = "\a"
+)
+
+type termState struct {
+	glyphs     string // blocks or braille
+	keyTimeout time.Duration
+	columns    int
+	rows       int // rows used by the display
+	saved      string
+	cells      [][]string // cells currently displayed
+	lock       sync.Mutex
+	pressed    map[string]time.Time // keys typed, by name
+	prompt     bool                 // keys go to the prompt
+	line       []byte
+	cli        *io.PipeWriter
+}
+
+var term termState
+
+// termCell returns the character displaying the pixels of a cell, with its
+// colors.
+func termCell(levels *filterLevels, p palette, column int, row int) string {
+	level := func(x int, y int) uint8 {
+		if x < SCREENWIDTH && y < SCREENHEIGHT {
+			return levels[x][y]
+		}
+		return 0
+	}
+	rgb := func(background bool, level uint8) string {
+		c := filterColor(level, p)
+		layer := 38
+		if background {
+			layer = 48
+		}
+		return fmt.Sprintf("\x1b[%d;2;%d;%d;%dm", layer, c.R, c.G, c.B)
+	}
+
+	if term.glyphs == "braille" {
+		// dots are numbered by column, top to bottom, the last row of the
+		// pattern being dots 7 and 8
+		bits := [4][2]rune{{0x01, 0x08}, {0x02, 0x10}, {0x04, 0x20}, {0x40, 0x80}}
+		pattern := rune(0x2800)
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 2; x++ {
+				if level(column*2+x, row*4+y) >= FILTERLEVELS/2 {
+					pattern |= bits[y][x]
+				}
+			}
+		}
+		return rgb(false, FILTERLEVELS-1) + rgb(true, 0) + string(pattern)
+	}
+
+	// upper half block, the foreground being the upper pixel and the
+	// background the lower one
+	return rgb(false, level(column, row*2)) + rgb(true, level(column, row*2+1)) + "▀"
+}
+
+// termInit sets the terminal up and returns the input of the CLI.
+func termInit(glyphs string, keyTimeout time.Duration) (io.Reader, error) {
+	if glyphs != "blocks" && glyphs != "braille" {
+		return nil, fmt.Errorf("unknown glyphs %s", glyphs)
+	}
+	term.glyphs = glyphs
+	term.keyTimeout = keyTimeout
+	term.pressed = make(map[string]time.Time)
+
+	term.columns, term.rows = SCREENWIDTH, SCREENHEIGHT/2
+	if glyphs == "braille" {
+		term.columns, term.rows = SCREENWIDTH/2, SCREENHEIGHT/4
+	}
+	term.cells = make([][]string, term.rows)
+	for row := range term.cells {
+		term.cells[row] = make([]string, term.columns)
+	}
+
+	saved, err := termStty("-g")
+	if err != nil {
+		return nil, err
+	}
+	term.saved = strings.TrimSpace(saved)
+	if _, err := termStty("-icanon", "-echo", "min", "1", "time", "0"); err != nil {
+		return nil, err
+	}
+
+	height := 24
+	if size, err := termStty("size"); err == nil {
+		if fields := strings.Fields(size); len(fields) == 2 {
+			if n, err := strconv.Atoi(fields[0]); err == nil {
+				height = n
+			}
+		}
+	}
+
+	// restore the terminal on ^C
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		termRestore()
+		os.Exit(1)
+	}()
+
+	// clear the screen, draw the separator and set the scrolling region of
+	// the prompt below the display
+	fmt.Printf("\x1b[2J\x1b[%d;1H%s", term.rows+1, strings.Repeat("─", term.columns))
+	fmt.Printf("\x1b[%d;%dr\x1b[%d;1H", term.rows+2, height, height)
+	fmt.Println("Tab switches the keyboard between the game and the prompt")
+
+	reader, writer := io.Pipe()
+	term.cli = writer
+	go termRunInput()
+	go termRunKeyReleases()
+	return reader, nil
+}
+
+// termRedraw writes the cells that changed since the previous redraw.
+func termRedraw(snapshot *machineSnapshot) {
+	var buffer bytes.Buffer
+	for row := 0; row < term.rows; row++ {
+		for column := 0; column < term.columns; column++ {
+			cell := termCell(&snapshot.display, snapshot.palette, column, row)
+			if cell != term.cells[row][column] {
+				term.cells[row][column] = cell
+				fmt.Fprintf(&buffer, "\x1b[%d;%dH%s", row+1, column+1, cell)
+			}
+		}
+	}
+	if buffer.Len() > 0 {
+		// save and restore the cursor of the prompt around the update
+		os.Stdout.WriteString("\x1b7" + buffer.String() + "\x1b[0m\x1b8")
+	}
+}
+
+// termRestore puts the terminal back in the state it was before termInit.
+// It does nothing if the terminal frontend is not used.
+func termRestore() {
+	if term.saved == "" {
+		return
+	}
+	fmt.Printf("\x1b[r\x1b[0m\n")
+	termStty(term.saved)
+	term.saved = ""
+}
+
+func termRunBuzzer(ctx context.Context, buzz chan struct{}) {
+	playing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-buzz:
+		}
+		sound := machineSnapshotLatest().sounding
+		if sound && !playing {
+			os.Stdout.WriteString(TERMBELL)
+		}
+		playing = sound
+	}
+}
+
+func termRunDisplay(ctx context.Context, draw chan struct{}) {
+	termRedraw(machineSnapshotLatest())
+	for {
+		// the palette may have changed
+		select {
+		case <-ctx.Done():
+			return
+		case <-draw:
+		case <-displayUpdate:
+		}
+		termRedraw(machineSnapshotLatest())
+	}
+}
+
+// termRunInput reads the keys typed and sends them to the keypad or to the
+// prompt.
+func termRunInput() {
+	input := make([]byte, 1)
+	var character []byte // bytes of a UTF-8 character typed
+	for {
+		if _, err := os.Stdin.Read(input); err != nil {
+			term.cli.Close()
+			return
+		}
+		c := input[0]
+
+		if c == TERMFOCUSKEY {
+			term.prompt = !term.prompt
+			continue
+		}
+
+		if !term.prompt {
+			// the keys are mapped to the keypad by the emulation goroutine
+			character = append(character, c)
+			if !utf8.FullRune(character) {
+				continue
+			}
+			name := string(character)
+			character = character[:0]
+			term.lock.Lock()
+			term.pressed[name] = time.Now()
+			term.lock.Unlock()
+			machineSendKey(name, false, true)
+			continue
+		}
+
+		switch c {
+		case '\n', '\r':
+			os.Stdout.WriteString("\n")
+			term.cli.Write(append(term.line, '\n'))
+			term.line = term.line[:0]
+		case 0x7f, 0x08:
+			if len(term.line) > 0 {
+				term.line = term.line[:len(term.line)-1]
+				os.Stdout.WriteString("\b \b")
+			}
+		case 0x04:
+			term.cli.Close()
+		default:
+			if c >= ' ' {
+				term.line = append(term.line, c)
+				os.Stdout.Write(input)
+			}
+		}
+	}
+}
+
+// termRunKeyReleases releases the keypad keys not received for longer than
+// the key timeout.
+func termRunKeyReleases() {
+	for range time.Tick(10 * time.Millisecond) {
+		term.lock.Lock()
+		for name, pressed := range term.pressed {
+			if time.Since(pressed) > term.keyTimeout {
+				delete(term.pressed, name)
+				machineSendKey(name, false, false)
+			}
+		}
+		term.lock.Unlock()
+	}
+}
+
+// termStty runs stty on the terminal.
+func termStty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	output, err := cmd.Output()
+	return string(output), err
+}
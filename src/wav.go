@@ -0,0 +1,95 @@
+package main
+
+// WAV recordings of the beeper
+//
+// The samples generated by the beeper at every 60Hz frame, silent or not,
+// are recorded and written as a 16 bits mono PCM WAV file when the recording
+// stops, so that one second of the file is 60 frames of the machine. It does
+// not need any audio device and works with every frontend. A WAV recording
+// can be started along with a display recording, both then covering the
+// same frames.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type wavRecording struct {
+	path    string
+	samples []int16
+}
+
+// wavRecorder is nil unless a recording is in progress.
+var wavRecorder *wavRecording
+
+func wavCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing start or stop")
+	}
+
+	switch args[0] {
+	case "start":
+		if len(args) < 2 {
+			return errors.New("missing file name")
+		}
+		return wavStart(args[1])
+	case "stop":
+		return wavStop()
+	default:
+		return fmt.Errorf("invalid wav command %s", args[0])
+	}
+}
+
+// wavEncode writes the RIFF header and the samples.
+func wavEncode(w *bufio.Writer, samples []int16) error {
+	size := uint32(2 * len(samples))
+	w.WriteString("RIFF")
+	binary.Write(w, binary.LittleEndian, 36+size)
+	w.WriteString("WAVEfmt ")
+	binary.Write(w, binary.LittleEndian, []uint32{16})
+	binary.Write(w, binary.LittleEndian, []uint16{1, 1}) // PCM, mono
+	binary.Write(w, binary.LittleEndian, []uint32{AUDIOSAMPLEHZ, 2 * AUDIOSAMPLEHZ})
+	binary.Write(w, binary.LittleEndian, []uint16{2, 16}) // block align, bits per sample
+	w.WriteString("data")
+	binary.Write(w, binary.LittleEndian, size)
+	binary.Write(w, binary.LittleEndian, samples)
+	return w.Flush()
+}
+
+// wavRecord is called by the beeper with the samples of every frame.
+func wavRecord(samples []int16) {
+	if r := wavRecorder; r != nil {
+		r.samples = append(r.samples, samples...)
+	}
+}
+
+func wavStart(path string) error {
+	if wavRecorder != nil {
+		return fmt.Errorf("already recording to %s", wavRecorder.path)
+	}
+	wavRecorder = &wavRecording{path: path}
+	return nil
+}
+
+func wavStop() error {
+	r := wavRecorder
+	if r == nil {
+		return errors.New("not recording")
+	}
+	wavRecorder = nil
+
+	file, err := os.Create(r.path)
+	if err != nil {
+		return err
+	}
+	if err := wavEncode(bufio.NewWriter(file), r.samples); err != nil {
+		file.Close()
+		return err
+	}
+	frames := len(r.samples) / AUDIOFRAMESAMPLES
+	fmt.Printf("Recorded %d frames (%.2fs) of sound to %s\n", frames, float64(frames)/60, r.path)
+	return file.Close()
+}
@@ -0,0 +1,154 @@
+package main
+
+// Cross references
+//
+// The xref command lists the instructions referencing an address: jumps
+// (JP addr), calls, computed jumps (JP V0, addr) and loads of I (LD I,
+// addr). Instructions are found by following the flow of the program from
+// 0x200, through jumps, calls and skips, and completed by the instructions
+// the coverage map shows were executed, which includes the code reached by
+// computed jumps. Every reference tells how its instruction was found.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type xrefReference struct {
+	address uint16 // of the referencing instruction
+	kind    string // jump, call, jump0 or load
+	found   string // static, executed or static and executed
+}
+
+// xrefCode returns the addresses of the instructions, and how they were
+// found.
+func xrefCode() map[uint16]string {
+	code := make(map[uint16]string)
+
+	// static flow from the start of the program
+	pending := []uint16{MEMPROGRAMSTART}
+	for len(pending) > 0 {
+		address := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for int(address)+1 < MEMEND && code[address] == "" {
+			word := machineGetInstruction(address)
+			decoded := machineDisassembleInstruction(word)
+			if word == 0 || decoded.op == invalid {
+				// most likely data reached by the end of a loop
+				break
+			}
+			code[address] = "static"
+
+			next := address + 2
+			switch decoded.op {
+			case jmp:
+				next = decoded.nnn
+			case call:
+				pending = append(pending, decoded.nnn)
+			case seb, sneb, ser, sner, skp, sknp:
+				pending = append(pending, address+4)
+			case ret, jpv:
+				next = MEMEND
+			}
+			address = next
+		}
+	}
+
+	// instructions executed, starting at even addresses unless the byte
+	// before was not executed
+	for address := MEMPROGRAMSTART; address+1 < MEMEND; address++ {
+		if coverage[address]&COVEXECUTED == 0 {
+			continue
+		}
+		if address%2 != 0 && coverage[address-1]&COVEXECUTED != 0 {
+			continue
+		}
+		switch code[uint16(address)] {
+		case "":
+			code[uint16(address)] = "executed"
+		case "static":
+			code[uint16(address)] = "static and executed"
+		}
+	}
+	return code
+}
+
+// xrefCommand prints the references to an address or label, or the
+// references to every address.
+func xrefCommand(args []string) error {
+	index := xrefIndex()
+
+	if len(args) > 0 {
+		target, err := asmNumber(args[0])
+		if err != nil {
+			return err
+		}
+		if target >= MEMEND {
+			return errors.New("invalid address")
+		}
+		xrefPrint(target, index[target])
+		return nil
+	}
+
+	targets := make([]uint16, 0, len(index))
+	for target := range index {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+	for _, target := range targets {
+		xrefPrint(target, index[target])
+	}
+	return nil
+}
+
+// xrefIndex returns the references to every address referenced.
+func xrefIndex() map[uint16][]xrefReference {
+	kinds := map[opcode]string{jmp: "jump", call: "call", jpv: "jump0", ldi: "load"}
+
+	code := xrefCode()
+	addresses := make([]uint16, 0, len(code))
+	for address := range code {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+
+	index := make(map[uint16][]xrefReference)
+	for _, address := range addresses {
+		decoded := machineDisassembleInstruction(machineGetInstruction(address))
+		if kind, ok := kinds[decoded.op]; ok {
+			index[decoded.nnn] = append(index[decoded.nnn], xrefReference{address, kind, code[address]})
+		}
+	}
+	return index
+}
+
+// xrefMain prints the references to every address of a program, without
+// running it, patched by the patch file unless it is empty, and returns the
+// exit code.
+func xrefMain(program string, patch string) int {
+	machineInitialize()
+	if err := machineLoadProgram(program, patch); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	xrefCommand(nil)
+	return 0
+}
+
+func xrefPrint(target uint16, references []xrefReference) {
+	name := fmt.Sprintf("0x%03x", target)
+	if label, ok := symbolsLabel(target); ok {
+		name += " " + label
+	}
+	if len(references) == 0 {
+		fmt.Printf("%s: no references\n", name)
+		return
+	}
+	fmt.Printf("%s referenced by:\n", name)
+	for _, r := range references {
+		text := fmt.Sprintf("0x%03x: 0x%04x %s", r.address, machineGetInstruction(r.address), disasmInstruction(r.address))
+		fmt.Printf("  %-36s %s, %s\n", text, r.kind, r.found)
+	}
+}